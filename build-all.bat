@@ -49,7 +49,7 @@ echo [4/5] Compilando Updater (Mac ARM64)...
 set GOOS=darwin
 set GOARCH=arm64
 set CGO_ENABLED=0
-go build -o updater-mac ./updater-src/main.go
+go build -o updater-mac ./updater-src
 if %errorlevel% neq 0 (
     echo [ERROR] Fallo compilando updater-mac
     exit /b 1
@@ -59,6 +59,19 @@ set GOARCH=
 set CGO_ENABLED=
 echo [OK] updater-mac creado (para Mac M1/M2/M3/M4)
 
+set GOOS=linux
+set GOARCH=amd64
+set CGO_ENABLED=0
+go build -o updater-linux ./updater-src
+if %errorlevel% neq 0 (
+    echo [ERROR] Fallo compilando updater-linux
+    exit /b 1
+)
+set GOOS=
+set GOARCH=
+set CGO_ENABLED=
+echo [OK] updater-linux creado (para servidores Linux amd64)
+
 echo.
 echo [5/5] Generando claves Ed25519 (si no existen)...
 if not exist deploy-private.key (
@@ -83,6 +96,7 @@ echo   - deployer.exe      (para subir desde Windows)
 echo   - deployer-mac      (para subir desde Mac M1/M2/M3/M4)
 echo   - nexo.exe          (para instalar en VPS Windows)
 echo   - updater-mac       (para correr en Mac M4)
+echo   - updater-linux     (para correr en Linux amd64)
 echo   - deploy-private.key (clave privada - GUARDAR SEGURA)
 echo   - deploy-public.key  (clave publica - distribuir a VPS y Mac)
 echo.
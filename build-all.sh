@@ -33,13 +33,20 @@ echo "[OK] nexo.exe creado (para VPS Windows)"
 
 echo ""
 echo "[3/4] Compilando Updater (Mac ARM64)..."
-go build -o updater-mac ./updater-src/main.go
+go build -o updater-mac ./updater-src
 if [ $? -ne 0 ]; then
     echo "[ERROR] Fallo compilando updater-mac"
     exit 1
 fi
 echo "[OK] updater-mac creado (para Mac M1/M2/M3/M4)"
 
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o updater-linux ./updater-src
+if [ $? -ne 0 ]; then
+    echo "[ERROR] Fallo compilando updater-linux"
+    exit 1
+fi
+echo "[OK] updater-linux creado (para servidores Linux amd64)"
+
 echo ""
 echo "[4/4] Generando claves Ed25519 (si no existen)..."
 if [ ! -f deploy-private.key ]; then
@@ -68,6 +75,7 @@ echo "Archivos generados:"
 echo "  - deployer-mac        (para subir desde Mac M1/M2/M3/M4)"
 echo "  - nexo.exe            (para instalar en VPS Windows)"
 echo "  - updater-mac         (para correr en Mac M4 destino)"
+echo "  - updater-linux       (para correr en Linux amd64)"
 echo "  - deploy-private.key  (clave privada - GUARDAR SEGURA)"
 echo "  - deploy-public.key   (clave pública - distribuir a VPS y Mac)"
 echo ""
@@ -0,0 +1,10 @@
+module github.com/jonathanhecl/gigabot-remote-updater
+
+go 1.20
+
+require (
+	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
+)
+
+require golang.org/x/sys v0.15.0 // indirect
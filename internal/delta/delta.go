@@ -0,0 +1,202 @@
+// Package delta implementa el formato de los patches binarios entre
+// releases: Nexo los genera con Encode y el updater los aplica con Apply.
+//
+// Formato:
+//
+//	"GBDELTA1" | SHA-256 del origen (32 bytes) | tamaño destino (uvarint)
+//	gzip( operaciones... 'E' )
+//
+// Cada operación es 'C' offset longitud (copiar del binario de origen) o
+// 'I' longitud bytes (insertar bytes nuevos), con enteros en uvarint.
+// Es un delta estilo rsync: el origen se indexa por bloques alineados con
+// un hash rodante y el destino se recorre byte a byte buscando bloques
+// iguales, que después se extienden hacia adelante y hacia atrás.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magic     = "GBDELTA1"
+	blockSize = 64
+)
+
+// ErrWrongSource indica que el patch se generó para otro binario de origen.
+var ErrWrongSource = errors.New("el patch es para otro binario")
+
+// Encode escribe en w el patch que convierte source en target.
+// sourceChecksum es el SHA-256 de source, que ya calculó quien llama.
+func Encode(w io.Writer, source, target []byte, sourceChecksum [32]byte) error {
+	header := append([]byte(magic), sourceChecksum[:]...)
+	header = binary.AppendUvarint(header, uint64(len(target)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	ops := bufio.NewWriter(gz)
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(v int) {
+		n := binary.PutUvarint(scratch[:], uint64(v))
+		ops.Write(scratch[:n])
+	}
+	insert := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		ops.WriteByte('I')
+		writeUvarint(len(data))
+		ops.Write(data)
+	}
+
+	index := make(map[uint32]int, len(source)/blockSize)
+	for offset := 0; offset+blockSize <= len(source); offset += blockSize {
+		a, b := weakHash(source[offset : offset+blockSize])
+		key := a&0xffff | b<<16
+		if _, ok := index[key]; !ok {
+			index[key] = offset
+		}
+	}
+
+	literal := 0 // inicio de los bytes de destino que todavía no se emitieron
+	i := 0
+	var a, b uint32
+	if len(target) >= blockSize {
+		a, b = weakHash(target[:blockSize])
+	}
+	for i+blockSize <= len(target) {
+		offset, ok := index[a&0xffff|b<<16]
+		if ok && bytes.Equal(source[offset:offset+blockSize], target[i:i+blockSize]) {
+			n := blockSize
+			for offset+n < len(source) && i+n < len(target) && source[offset+n] == target[i+n] {
+				n++
+			}
+			for offset > 0 && i > literal && source[offset-1] == target[i-1] {
+				offset--
+				i--
+				n++
+			}
+
+			insert(target[literal:i])
+			ops.WriteByte('C')
+			writeUvarint(offset)
+			writeUvarint(n)
+
+			i += n
+			literal = i
+			if i+blockSize <= len(target) {
+				a, b = weakHash(target[i : i+blockSize])
+			}
+			continue
+		}
+
+		if i+blockSize < len(target) {
+			out, in := uint32(target[i]), uint32(target[i+blockSize])
+			a = a - out + in
+			b = b - blockSize*out + a
+		}
+		i++
+	}
+	insert(target[literal:])
+	ops.WriteByte('E')
+
+	if err := ops.Flush(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// weakHash es el checksum rodante de rsync: a es la suma de los bytes y b
+// la suma ponderada por posición. Se actualiza en O(1) al avanzar un byte.
+func weakHash(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a, b
+}
+
+// Apply reconstruye el binario nuevo en dst a partir del binario actual
+// (source, de sourceSize bytes y SHA-256 sourceChecksum en hex) y un patch
+// generado con Encode. Las copias se leen de source de a partes, así que
+// ninguno de los dos binarios se carga entero en memoria. Quien llama debe
+// verificar el checksum del resultado.
+func Apply(patch io.Reader, source io.ReaderAt, sourceSize int64, sourceChecksum string, dst io.Writer) error {
+	header := bufio.NewReader(patch)
+	prefix := make([]byte, len(magic)+sha256.Size)
+	if _, err := io.ReadFull(header, prefix); err != nil {
+		return fmt.Errorf("patch truncado: %w", err)
+	}
+	if string(prefix[:len(magic)]) != magic {
+		return fmt.Errorf("formato de patch desconocido")
+	}
+	if fmt.Sprintf("%x", prefix[len(magic):]) != sourceChecksum {
+		return ErrWrongSource
+	}
+	targetSize, err := binary.ReadUvarint(header)
+	if err != nil {
+		return fmt.Errorf("patch truncado: %w", err)
+	}
+
+	gz, err := gzip.NewReader(header)
+	if err != nil {
+		return fmt.Errorf("patch corrupto: %w", err)
+	}
+	ops := bufio.NewReader(gz)
+
+	size := uint64(sourceSize)
+	var written uint64
+	for {
+		op, err := ops.ReadByte()
+		if err != nil {
+			return fmt.Errorf("patch truncado: %w", err)
+		}
+
+		switch op {
+		case 'C':
+			offset, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("patch truncado: %w", err)
+			}
+			length, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("patch truncado: %w", err)
+			}
+			if offset > size || length > size-offset || written+length > targetSize {
+				return fmt.Errorf("copia fuera de rango")
+			}
+			if _, err := io.Copy(dst, io.NewSectionReader(source, int64(offset), int64(length))); err != nil {
+				return err
+			}
+			written += length
+		case 'I':
+			length, err := binary.ReadUvarint(ops)
+			if err != nil {
+				return fmt.Errorf("patch truncado: %w", err)
+			}
+			if written+length > targetSize {
+				return fmt.Errorf("inserción fuera de rango")
+			}
+			if _, err := io.CopyN(dst, ops, int64(length)); err != nil {
+				return fmt.Errorf("patch truncado: %w", err)
+			}
+			written += length
+		case 'E':
+			if written != targetSize {
+				return fmt.Errorf("tamaño reconstruido %d, esperado %d", written, targetSize)
+			}
+			return nil
+		default:
+			return fmt.Errorf("operación de patch desconocida: %q", op)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package delta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func encode(t *testing.T, source, target []byte) []byte {
+	t.Helper()
+	var patch bytes.Buffer
+	if err := Encode(&patch, source, target, sha256.Sum256(source)); err != nil {
+		t.Fatal(err)
+	}
+	return patch.Bytes()
+}
+
+func apply(patch, source []byte) ([]byte, error) {
+	var out bytes.Buffer
+	checksum := fmt.Sprintf("%x", sha256.Sum256(source))
+	err := Apply(bytes.NewReader(patch), bytes.NewReader(source), int64(len(source)), checksum, &out)
+	return out.Bytes(), err
+}
+
+// rawPatch arma un patch a mano con las operaciones ya codificadas.
+func rawPatch(source []byte, targetSize int, ops []byte) []byte {
+	sum := sha256.Sum256(source)
+	patch := append([]byte(magic), sum[:]...)
+	patch = binary.AppendUvarint(patch, uint64(targetSize))
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(ops)
+	gz.Close()
+	return append(patch, body.Bytes()...)
+}
+
+func TestEncodeApply(t *testing.T) {
+	base := randomBytes(1, 64<<10)
+	tests := []struct {
+		name   string
+		source []byte
+		target []byte
+	}{
+		{"iguales", base, base},
+		{"destino vacío", base, nil},
+		{"origen vacío", nil, base},
+		{"más chico que un bloque", base, base[:10]},
+		{"bytes insertados en el medio", base, concat(base[:30000], []byte("nuevo"), base[30000:])},
+		{"bytes borrados", base, concat(base[:1000], base[5000:])},
+		{"bloques reordenados", base, concat(base[40000:], base[:40000])},
+		{"cambio de un byte", base, concat(base[:777], []byte{base[777] ^ 0xff}, base[778:])},
+		{"sin nada en común", base, randomBytes(2, 32<<10)},
+	}
+	for _, test := range tests {
+		patch := encode(t, test.source, test.target)
+		got, err := apply(patch, test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.target) {
+			t.Errorf("%s: el binario reconstruido no coincide (%d bytes, se esperaban %d)", test.name, len(got), len(test.target))
+		}
+	}
+
+	// Un cambio chico tiene que dar un patch chico
+	target := concat(base[:30000], []byte("nuevo"), base[30000:])
+	if patch := encode(t, base, target); len(patch) > len(target)/10 {
+		t.Errorf("patch de %d bytes para un cambio de 5 bytes", len(patch))
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	source := randomBytes(3, 16<<10)
+	target := concat(source[:8000], []byte("nuevo"), source[8000:])
+	patch := encode(t, source, target)
+
+	other := randomBytes(4, 16<<10)
+	if _, err := apply(patch, other); !errors.Is(err, ErrWrongSource) {
+		t.Errorf("origen equivocado: error %v, se esperaba ErrWrongSource", err)
+	}
+
+	corrupt := append([]byte{}, patch...)
+	corrupt[len(magic)+sha256.Size+4] ^= 0xff
+
+	tests := []struct {
+		name    string
+		patch   []byte
+		wantErr string
+	}{
+		{"vacío", nil, "truncado"},
+		{"solo el encabezado", patch[:len(magic)+10], "truncado"},
+		{"truncado en las operaciones", patch[:len(patch)-20], ""},
+		{"otro formato", append([]byte("GBDELTA0"), patch[len(magic):]...), "formato"},
+		{"encabezado gzip corrupto", corrupt, "corrupto"},
+		{"operación desconocida", rawPatch(source, 0, []byte{'X'}), "desconocida"},
+		{"copia fuera del origen", rawPatch(source, 100, []byte{'C', 0x80, 0x80, 0x01, 100}), "fuera de rango"},
+		{"copia más larga que el destino", rawPatch(source, 10, []byte{'C', 0, 100}), "fuera de rango"},
+		{"inserción más larga que el destino", rawPatch(source, 2, []byte{'I', 3, 'a', 'b', 'c'}), "fuera de rango"},
+		{"inserción truncada", rawPatch(source, 3, []byte{'I', 3, 'a'}), "truncado"},
+		{"destino incompleto", rawPatch(source, 5, []byte{'I', 3, 'a', 'b', 'c', 'E'}), "tamaño reconstruido"},
+		{"sin fin", rawPatch(source, 3, []byte{'I', 3, 'a', 'b', 'c'}), "truncado"},
+	}
+	for _, test := range tests {
+		_, err := apply(test.patch, source)
+		if err == nil {
+			t.Errorf("%s: se aplicó un patch inválido", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %q, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Package keyfile lee y escribe las claves Ed25519 de deployer, Nexo, updater
+// y genkeys.
+//
+// Las claves nuevas se escriben en PEM estándar: PKCS#8 ("PRIVATE KEY") para
+// la privada y PKIX ("PUBLIC KEY") para la pública, las mismas que generan
+//
+//	openssl genpkey -algorithm Ed25519 -out deploy-private.key
+//	openssl pkey -in deploy-private.key -pubout -out deploy-public.key
+//
+// Se siguen aceptando las claves del formato anterior (los 32 bytes de la
+// semilla o de la clave pública directamente bajo el mismo encabezado PEM)
+// y, para la pública, los 32 bytes en base64 sin PEM (keyrings).
+//
+// La clave privada puede guardarse cifrada con una passphrase (genkeys
+// -encrypt): el PKCS#8 va cifrado con AES-256-GCM y una clave derivada con
+// scrypt, en un bloque "GIGABOT ENCRYPTED PRIVATE KEY" con los parámetros en
+// los encabezados PEM.
+package keyfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const encryptedBlockType = "GIGABOT ENCRYPTED PRIVATE KEY"
+
+// PassphraseEnv es la variable de entorno de donde genkeys y el deployer
+// toman la passphrase cuando no hay terminal (CI).
+const PassphraseEnv = "GIGABOT_KEY_PASSPHRASE"
+
+// Parámetros de scrypt para claves nuevas (~100 ms y 32 MB por intento).
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrEncrypted indica que la clave privada está cifrada y hay que abrirla con
+// DecryptPrivateKey.
+var ErrEncrypted = errors.New("la clave privada está cifrada, hace falta la passphrase")
+
+// ParsePrivateKey lee una clave privada Ed25519 en PEM.
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, err := decodePEM(data, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	// Formato anterior de genkeys y Nexo: la semilla sola
+	if len(block.Bytes) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(block.Bytes), nil
+	}
+	return parsePKCS8(block.Bytes)
+}
+
+func parsePKCS8(der []byte) (ed25519.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("clave privada PKCS#8 inválida: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("la clave privada es %s, se esperaba Ed25519", algorithm(key))
+	}
+	return privateKey, nil
+}
+
+// ParsePublicKey lee una clave pública Ed25519 en PEM, o en base64 sin PEM.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	var der []byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		block, err := decodePEM(data, "PUBLIC KEY")
+		if err != nil {
+			return nil, err
+		}
+		der = block.Bytes
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+		if err != nil {
+			return nil, fmt.Errorf("clave pública en base64 inválida: %w", err)
+		}
+		der = decoded
+	}
+
+	// Formato anterior: la clave sola
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("clave pública PKIX inválida: %w", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("la clave pública es %s, se esperaba Ed25519", algorithm(key))
+	}
+	return publicKey, nil
+}
+
+// LoadPrivateKey lee y parsea un archivo de clave privada.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// LoadPublicKey lee y parsea un archivo de clave pública.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// IsEncrypted indica si el archivo tiene una clave privada cifrada con
+// passphrase.
+func IsEncrypted(data []byte) bool {
+	_, err := decodePEM(data, "PRIVATE KEY")
+	return errors.Is(err, ErrEncrypted)
+}
+
+// EncryptPrivateKey devuelve la clave privada en PEM cifrada con la
+// passphrase.
+func EncryptPrivateKey(key ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase vacía")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedBlockType,
+		Headers: map[string]string{
+			"KDF":        "scrypt",
+			"KDF-Params": fmt.Sprintf("N=%d,r=%d,p=%d", scryptN, scryptR, scryptP),
+			"Salt":       base64.StdEncoding.EncodeToString(salt),
+			"Cipher":     "AES-256-GCM",
+			"Nonce":      base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, nil),
+	}), nil
+}
+
+// DecryptPrivateKey abre una clave privada cifrada con EncryptPrivateKey.
+// Una clave sin cifrar se devuelve tal cual, ignorando la passphrase.
+func DecryptPrivateKey(data, passphrase []byte) (ed25519.PrivateKey, error) {
+	if !IsEncrypted(data) {
+		return ParsePrivateKey(data)
+	}
+
+	block, err := decodePEM(data, encryptedBlockType)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Headers["KDF"] != "scrypt" || block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, fmt.Errorf("cifrado no soportado: %s/%s", block.Headers["KDF"], block.Headers["Cipher"])
+	}
+	var n, r, p int
+	if _, err := fmt.Sscanf(block.Headers["KDF-Params"], "N=%d,r=%d,p=%d", &n, &r, &p); err != nil {
+		return nil, fmt.Errorf("parámetros de scrypt inválidos: %q", block.Headers["KDF-Params"])
+	}
+	// Límites para que un archivo manipulado no pida gigas de memoria
+	if n < 2 || n > 1<<20 || n&(n-1) != 0 || r < 1 || r > 32 || p < 1 || p > 16 {
+		return nil, fmt.Errorf("parámetros de scrypt fuera de rango: %q", block.Headers["KDF-Params"])
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("salt inválido")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.New("nonce inválido")
+	}
+
+	aead, err := newAEAD(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("nonce inválido")
+	}
+	der, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("passphrase incorrecta o archivo dañado")
+	}
+	return parsePKCS8(der)
+}
+
+func newAEAD(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadPassphrase obtiene la passphrase de una clave: del file descriptor fd
+// si es >= 0 (por ejemplo 3 con "3<archivo"), de PassphraseEnv, o pidiéndola
+// en la terminal sin eco. Con confirm se pide dos veces.
+func ReadPassphrase(prompt string, fd int, confirm bool) ([]byte, error) {
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "passphrase")
+		if f == nil {
+			return nil, fmt.Errorf("file descriptor %d inválido", fd)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, 4096))
+		if err != nil {
+			return nil, fmt.Errorf("no se puede leer la passphrase del fd %d: %w", fd, err)
+		}
+		// Solo el salto de línea final: los espacios son parte de la passphrase
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	stdin := int(os.Stdin.Fd())
+	if !term.IsTerminal(stdin) {
+		return nil, fmt.Errorf("no hay terminal para pedir la passphrase (usar %s o -passphrase-fd)", PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repetir passphrase: ")
+		again, err := term.ReadPassword(stdin)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("las passphrases no coinciden")
+		}
+	}
+	return passphrase, nil
+}
+
+// EncodePrivateKey devuelve la clave privada en PEM PKCS#8.
+func EncodePrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// EncodePublicKey devuelve la clave pública en PEM PKIX.
+func EncodePublicKey(key ed25519.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// WriteKeyPair genera un par de claves y lo guarda: la privada con permisos
+// 0600 (cifrada si hay passphrase) y la pública con 0644. No pisa una
+// privada que ya exista.
+func WriteKeyPair(privatePath, publicPath string, passphrase []byte) (ed25519.PrivateKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var privatePEM []byte
+	if passphrase != nil {
+		privatePEM, err = EncryptPrivateKey(privateKey, passphrase)
+	} else {
+		privatePEM, err = EncodePrivateKey(privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := EncodePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(privatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(privatePEM); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(publicPath, publicPEM, 0644); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// ID es el ID por defecto de una clave en los keyrings: los primeros 8
+// bytes de su SHA-256 en hex.
+func ID(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// decodePEM busca el bloque PEM del tipo indicado. Los demás tipos conocidos
+// dan un error que explica qué se encontró.
+func decodePEM(data []byte, blockType string) (*pem.Block, error) {
+	// Archivos editados en Windows
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("formato PEM inválido")
+		}
+		switch block.Type {
+		case blockType:
+			return block, nil
+		case "PRIVATE KEY", "PUBLIC KEY":
+			return nil, fmt.Errorf("se encontró una %s, se esperaba una %s", pemName(block.Type), pemName(blockType))
+		case encryptedBlockType:
+			if blockType == "PRIVATE KEY" {
+				return nil, ErrEncrypted
+			}
+			return nil, fmt.Errorf("se encontró una clave privada cifrada, se esperaba una %s", pemName(blockType))
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, errors.New("clave privada cifrada por OpenSSL, no está soportado (descifrarla con openssl pkey o cifrarla con genkeys -encrypt-key)")
+		case "RSA PRIVATE KEY", "RSA PUBLIC KEY":
+			return nil, errors.New("la clave es RSA, se esperaba Ed25519")
+		case "EC PRIVATE KEY":
+			return nil, errors.New("la clave es ECDSA, se esperaba Ed25519")
+		case "OPENSSH PRIVATE KEY":
+			return nil, errors.New("clave en formato OpenSSH, convertirla a PKCS#8 o generar una con genkeys")
+		}
+		// Otros bloques (por ejemplo "EC PARAMETERS") se saltean
+		data = rest
+	}
+}
+
+func pemName(blockType string) string {
+	if blockType == "PRIVATE KEY" {
+		return "clave privada"
+	}
+	return "clave pública"
+}
+
+func algorithm(key interface{}) string {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return "ECDSA"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
@@ -0,0 +1,258 @@
+package keyfile
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pemBlock(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := EncodePrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaDER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	publicPEM, _ := EncodePublicKey(privateKey.Public().(ed25519.PublicKey))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"PKCS#8", pkcs8, ""},
+		{"PKCS#8 con BOM de Windows", append([]byte("\xef\xbb\xbf"), pkcs8...), ""},
+		{"semilla sola (formato anterior)", pemBlock("PRIVATE KEY", privateKey.Seed()), ""},
+		{"PKCS#8 después de otro bloque", append(pemBlock("EC PARAMETERS", []byte{1}), pkcs8...), ""},
+		{"ECDSA en PKCS#8", pemBlock("PRIVATE KEY", ecDER), "es ECDSA"},
+		{"RSA en PKCS#8", pemBlock("PRIVATE KEY", rsaDER), "es RSA"},
+		{"RSA PKCS#1", pemBlock("RSA PRIVATE KEY", []byte{1}), "es RSA"},
+		{"ECDSA SEC 1", pemBlock("EC PRIVATE KEY", []byte{1}), "es ECDSA"},
+		{"OpenSSH", pemBlock("OPENSSH PRIVATE KEY", []byte{1}), "OpenSSH"},
+		{"cifrada por OpenSSL", pemBlock("ENCRYPTED PRIVATE KEY", []byte{1}), "OpenSSL"},
+		{"clave pública", publicPEM, "se encontró una clave pública"},
+		{"DER inválido", pemBlock("PRIVATE KEY", []byte("basura")), "PKCS#8 inválida"},
+		{"sin PEM", []byte("basura"), "PEM inválido"},
+	}
+	for _, test := range tests {
+		got, err := ParsePrivateKey(test.data)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if !got.Equal(privateKey) {
+				t.Errorf("%s: la clave leída no coincide", test.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := EncodePublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkixDER, _ := x509.MarshalPKIXPublicKey(publicKey)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	privatePEM, _ := EncodePrivateKey(privateKey)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"PKIX", pkix, ""},
+		{"clave sola (formato anterior)", pemBlock("PUBLIC KEY", publicKey), ""},
+		{"base64 sin PEM (keyrings)", []byte(base64.StdEncoding.EncodeToString(publicKey) + "\n"), ""},
+		{"PKIX en base64 sin PEM", []byte(base64.StdEncoding.EncodeToString(pkixDER)), ""},
+		{"ECDSA en PKIX", pemBlock("PUBLIC KEY", ecDER), "es ECDSA"},
+		{"RSA PKCS#1", pemBlock("RSA PUBLIC KEY", []byte{1}), "es RSA"},
+		{"clave privada", privatePEM, "se encontró una clave privada"},
+		{"base64 inválido", []byte("no es base64!"), "base64 inválida"},
+		{"DER inválido", pemBlock("PUBLIC KEY", []byte("basura")), "PKIX inválida"},
+	}
+	for _, test := range tests {
+		got, err := ParsePublicKey(test.data)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if !got.Equal(publicKey) {
+				t.Errorf("%s: la clave leída no coincide", test.name)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestEncryptPrivateKey(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("una passphrase larga")
+	encrypted, err := EncryptPrivateKey(privateKey, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsEncrypted(encrypted) {
+		t.Error("IsEncrypted = false para una clave cifrada")
+	}
+	if _, err := ParsePrivateKey(encrypted); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("ParsePrivateKey sobre una clave cifrada: %v, se esperaba ErrEncrypted", err)
+	}
+	if _, err := ParsePublicKey(encrypted); err == nil {
+		t.Error("ParsePublicKey aceptó una clave privada cifrada")
+	}
+	if _, err := EncryptPrivateKey(privateKey, nil); err == nil {
+		t.Error("se cifró con una passphrase vacía")
+	}
+
+	got, err := DecryptPrivateKey(encrypted, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(privateKey) {
+		t.Error("la clave descifrada no coincide")
+	}
+
+	plain, _ := EncodePrivateKey(privateKey)
+	if IsEncrypted(plain) {
+		t.Error("IsEncrypted = true para una clave sin cifrar")
+	}
+	if got, err := DecryptPrivateKey(plain, nil); err != nil || !got.Equal(privateKey) {
+		t.Errorf("DecryptPrivateKey sobre una clave sin cifrar: %v", err)
+	}
+
+	block, _ := pem.Decode(encrypted)
+	tamper := func(change func(block *pem.Block)) []byte {
+		copied := &pem.Block{Type: block.Type, Headers: map[string]string{}, Bytes: bytes.Clone(block.Bytes)}
+		for k, v := range block.Headers {
+			copied.Headers[k] = v
+		}
+		change(copied)
+		return pem.EncodeToMemory(copied)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		wantErr    string
+	}{
+		{"passphrase incorrecta", encrypted, "otra passphrase", "passphrase incorrecta"},
+		{"texto cifrado modificado", tamper(func(b *pem.Block) { b.Bytes[0] ^= 1 }), string(passphrase), "passphrase incorrecta o archivo dañado"},
+		{"texto cifrado truncado", tamper(func(b *pem.Block) { b.Bytes = b.Bytes[:len(b.Bytes)-1] }), string(passphrase), "archivo dañado"},
+		{"salt cambiado", tamper(func(b *pem.Block) { b.Headers["Salt"] = base64.StdEncoding.EncodeToString([]byte("otro salt")) }), string(passphrase), "archivo dañado"},
+		{"nonce de otro tamaño", tamper(func(b *pem.Block) { b.Headers["Nonce"] = base64.StdEncoding.EncodeToString([]byte{1, 2, 3}) }), string(passphrase), "nonce inválido"},
+		{"otro cifrado", tamper(func(b *pem.Block) { b.Headers["Cipher"] = "AES-128-CBC" }), string(passphrase), "cifrado no soportado"},
+		{"scrypt gigante", tamper(func(b *pem.Block) { b.Headers["KDF-Params"] = "N=1073741824,r=8,p=1" }), string(passphrase), "fuera de rango"},
+		{"scrypt ilegible", tamper(func(b *pem.Block) { b.Headers["KDF-Params"] = "N=muchos" }), string(passphrase), "parámetros de scrypt inválidos"},
+	}
+	for _, test := range tests {
+		_, err := DecryptPrivateKey(test.data, []byte(test.passphrase))
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestWriteKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	privatePath, publicPath := filepath.Join(dir, "deploy-private.key"), filepath.Join(dir, "deploy-public.key")
+
+	privateKey, err := WriteKeyPair(privatePath, publicPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LoadPrivateKey(privatePath); err != nil || !got.Equal(privateKey) {
+		t.Errorf("LoadPrivateKey: %v", err)
+	}
+	if got, err := LoadPublicKey(publicPath); err != nil || !got.Equal(privateKey.Public()) {
+		t.Errorf("LoadPublicKey: %v", err)
+	}
+	if _, err := WriteKeyPair(privatePath, publicPath, nil); err == nil {
+		t.Error("WriteKeyPair pisó una clave privada existente")
+	}
+
+	encryptedPath := filepath.Join(dir, "cifrada-private.key")
+	privateKey, err = WriteKeyPair(encryptedPath, filepath.Join(dir, "cifrada-public.key"), []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(encryptedPath)
+	if got, err := DecryptPrivateKey(data, []byte("passphrase")); err != nil || !got.Equal(privateKey) {
+		t.Errorf("DecryptPrivateKey de la clave escrita: %v", err)
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	readFD := func(content string) ([]byte, error) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(content)
+		w.Close()
+		passphrase, err := ReadPassphrase("", int(r.Fd()), false)
+		r.Close()
+		return passphrase, err
+	}
+
+	t.Setenv(PassphraseEnv, "desde el entorno")
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"salto de línea final", "secreto\n", "secreto"},
+		{"CRLF de Windows", "secreto\r\n", "secreto"},
+		{"espacios", "  con espacios  \n", "  con espacios  "},
+		{"sin salto de línea", "secreto", "secreto"},
+	}
+	for _, test := range tests {
+		got, err := readFD(test.content)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: passphrase %q (%v), se esperaba %q (el fd tiene prioridad sobre el entorno)", test.name, got, err, test.want)
+		}
+	}
+
+	got, err := ReadPassphrase("", -1, false)
+	if err != nil || string(got) != "desde el entorno" {
+		t.Errorf("desde %s: passphrase %q (%v)", PassphraseEnv, got, err)
+	}
+}
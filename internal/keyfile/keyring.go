@@ -0,0 +1,331 @@
+package keyfile
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CoSignature es la firma de otra clave del keyring sobre el manifest de una
+// release ya subida. El manifest incluye checksum y tamaño del binario, así
+// que alcanza para autenticarlo.
+type CoSignature struct {
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"` // Ed25519 sobre los bytes del manifest
+	SignedAt  string `json:"signed_at"`
+}
+
+// KeyEntry es una clave de deploy de confianza. La ventana de validez es
+// opcional: fuera de ella no se acepta ninguna firma de esa clave.
+type KeyEntry struct {
+	ID        string `json:"id"`                   // default: keyID de la clave
+	PublicKey string `json:"public_key"`           // 32 bytes en base64, o el PEM completo
+	NotBefore string `json:"not_before,omitempty"` // RFC3339
+	NotAfter  string `json:"not_after,omitempty"`  // RFC3339
+}
+
+// Keyring es el archivo de keyring de Nexo y del updater.
+type Keyring struct {
+	Keys []*KeyEntry `json:"keys"`
+}
+
+// KeyRotation es una release de rotación de claves: agrega claves al
+// keyring y retira otras. La firman claves en las que ya se confía (tantas
+// como pide signature_threshold, igual que una release), así los updaters
+// aprenden la clave nueva de una firma de la vieja. Sequence ordena las
+// rotaciones (el deployer usa el Unix time).
+type KeyRotation struct {
+	Sequence int64       `json:"sequence"`
+	IssuedAt string      `json:"issued_at"`
+	Add      []*KeyEntry `json:"add,omitempty"`
+	Revoke   []string    `json:"revoke,omitempty"` // IDs que dejan de valer desde issued_at
+}
+
+// SignedRotation es una KeyRotation como la sube el deployer y la sirve
+// /keys: el JSON en base64, la firma Ed25519 sobre esos bytes y las
+// co-firmas de otras claves sobre los mismos bytes.
+type SignedRotation struct {
+	Sequence   int64          `json:"sequence"`
+	Rotation   string         `json:"rotation"`
+	KeyID      string         `json:"key_id"`
+	Signature  string         `json:"signature"`
+	Signatures []*CoSignature `json:"signatures,omitempty"`
+}
+
+// Key es una KeyEntry ya parseada. Las fechas en cero no limitan.
+type Key struct {
+	ID        string
+	PublicKey ed25519.PublicKey
+	NotBefore time.Time
+	NotAfter  time.Time
+	// FromRotation marca las claves que agregó una rotación y no el
+	// operador. No cuentan para el umbral de firmas salvo que la policy
+	// las liste.
+	FromRotation bool
+}
+
+// ValidAt indica si t cae dentro de la ventana de validez de la clave.
+func (k *Key) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	return k.NotAfter.IsZero() || t.Before(k.NotAfter)
+}
+
+// KeyIDs lista los IDs del keyring para los logs, marcando las claves fuera
+// de vigencia.
+func KeyIDs(keys []*Key) []string {
+	ids := []string{}
+	now := time.Now()
+	for _, key := range keys {
+		if key.ValidAt(now) {
+			ids = append(ids, key.ID)
+		} else {
+			ids = append(ids, key.ID+" (fuera de vigencia)")
+		}
+	}
+	return ids
+}
+
+// VerifyWithKeys prueba verify con la clave id (o con todas si id está
+// vacío, como en las releases de deployers anteriores). Solo cuentan las
+// claves vigentes: una release firmada con una clave retirada ya no se
+// instala.
+func VerifyWithKeys(keys []*Key, id string, verify func(ed25519.PublicKey) bool) error {
+	now := time.Now()
+	tried := false
+	for _, key := range keys {
+		if (id != "" && key.ID != id) || !key.ValidAt(now) {
+			continue
+		}
+		tried = true
+		if verify(key.PublicKey) {
+			return nil
+		}
+	}
+	if !tried {
+		if id == "" {
+			return errors.New("no hay claves vigentes en el keyring")
+		}
+		return fmt.Errorf("clave %s desconocida o fuera de su ventana de validez", id)
+	}
+	return errors.New("firma no coincide")
+}
+
+// ValidSigners verifica signatures sobre message y devuelve los IDs de las
+// claves que firmaron, sin repetir. Solo cuentan claves vigentes y, si
+// policy no está vacía, las que aparecen en ella. Sin policy no cuentan las
+// claves agregadas por rotaciones: una sola clave filtrada no puede sumar
+// claves propias y llegar sola al umbral.
+func ValidSigners(keys []*Key, policy []string, message []byte, signatures []*CoSignature) []string {
+	signers := []string{}
+	now := time.Now()
+	for _, cosignature := range signatures {
+		signature, err := base64.StdEncoding.DecodeString(cosignature.Signature)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if (cosignature.KeyID != "" && key.ID != cosignature.KeyID) || !key.ValidAt(now) {
+				continue
+			}
+			if contains(signers, key.ID) || (len(policy) > 0 && !contains(policy, key.ID)) {
+				continue
+			}
+			if len(policy) == 0 && key.FromRotation {
+				continue
+			}
+			if ed25519.Verify(key.PublicKey, message, signature) {
+				signers = append(signers, key.ID)
+				break
+			}
+		}
+	}
+	return signers
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadKeyring lee un archivo Keyring. Tiene que tener al menos una clave y
+// ningún ID repetido.
+func LoadKeyring(path string) ([]*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring Keyring
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(keyring.Keys) == 0 {
+		return nil, fmt.Errorf("%s no tiene claves", path)
+	}
+
+	keys := []*Key{}
+	for _, entry := range keyring.Keys {
+		key, err := ParseKeyEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, existing := range keys {
+			if existing.ID == key.ID {
+				return nil, fmt.Errorf("%s: clave %s repetida", path, key.ID)
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ParseKeyEntry parsea la clave pública y la ventana de validez de entry.
+// Sin ID, la clave se identifica con su keyID.
+func ParseKeyEntry(entry *KeyEntry) (*Key, error) {
+	publicKey, err := ParsePublicKey([]byte(entry.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("clave %q: %w", entry.ID, err)
+	}
+	key := &Key{ID: entry.ID, PublicKey: publicKey}
+	if key.ID == "" {
+		key.ID = ID(publicKey)
+	}
+	if entry.NotBefore != "" {
+		if key.NotBefore, err = time.Parse(time.RFC3339, entry.NotBefore); err != nil {
+			return nil, fmt.Errorf("clave %s: not_before inválido", key.ID)
+		}
+	}
+	if entry.NotAfter != "" {
+		if key.NotAfter, err = time.Parse(time.RFC3339, entry.NotAfter); err != nil {
+			return nil, fmt.Errorf("clave %s: not_after inválido", key.ID)
+		}
+	}
+	return key, nil
+}
+
+// VerifyRotation comprueba que la rotación esté firmada por una clave
+// vigente de keys y, con threshold > 1, que tenga firmas de al menos
+// threshold claves distintas según policy (ver ValidSigners). Devuelve la
+// rotación decodificada.
+func VerifyRotation(keys []*Key, policy []string, threshold int, signed *SignedRotation) (*KeyRotation, error) {
+	rotationJSON, err := base64.StdEncoding.DecodeString(signed.Rotation)
+	if err != nil {
+		return nil, errors.New("rotación en base64 inválida")
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, errors.New("firma en base64 inválida")
+	}
+	err = VerifyWithKeys(keys, signed.KeyID, func(publicKey ed25519.PublicKey) bool {
+		return ed25519.Verify(publicKey, rotationJSON, signature)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if threshold > 1 {
+		if signers := RotationSigners(keys, policy, signed); len(signers) < threshold {
+			return nil, fmt.Errorf("la rotación tiene %d de %d firmas requeridas", len(signers), threshold)
+		}
+	}
+	return DecodeRotation(signed)
+}
+
+// RotationSigners devuelve las claves distintas con una firma válida de la
+// rotación (la principal y las co-firmas), con las mismas reglas que
+// ValidSigners.
+func RotationSigners(keys []*Key, policy []string, signed *SignedRotation) []string {
+	rotationJSON, err := base64.StdEncoding.DecodeString(signed.Rotation)
+	if err != nil {
+		return []string{}
+	}
+	signatures := []*CoSignature{{KeyID: signed.KeyID, Signature: signed.Signature}}
+	signatures = append(signatures, signed.Signatures...)
+	return ValidSigners(keys, policy, rotationJSON, signatures)
+}
+
+// DecodeRotation decodifica la rotación sin verificar la firma, para las
+// que ya se verificaron al recibirlas. signed.Sequence en cero (una rotación
+// recién subida) no se compara.
+func DecodeRotation(signed *SignedRotation) (*KeyRotation, error) {
+	rotationJSON, err := base64.StdEncoding.DecodeString(signed.Rotation)
+	if err != nil {
+		return nil, errors.New("rotación en base64 inválida")
+	}
+	var rotation KeyRotation
+	if err := json.Unmarshal(rotationJSON, &rotation); err != nil {
+		return nil, errors.New("rotación ilegible")
+	}
+	if rotation.Sequence <= 0 || (signed.Sequence != 0 && signed.Sequence != rotation.Sequence) {
+		return nil, errors.New("sequence inválido")
+	}
+	if _, err := time.Parse(time.RFC3339, rotation.IssuedAt); err != nil {
+		return nil, errors.New("issued_at inválido")
+	}
+	return &rotation, nil
+}
+
+// ApplyRotation devuelve el keyring con la rotación aplicada, sin modificar
+// el original. Las claves nuevas quedan marcadas con FromRotation y las
+// retiradas vencen en issued_at. Una clave que se vuelve a agregar con el
+// mismo ID solo puede acotar su ventana de validez: una rotación no revive
+// una clave retirada ni extiende la que configuró el operador.
+func ApplyRotation(keys []*Key, rotation *KeyRotation) ([]*Key, error) {
+	issuedAt, err := time.Parse(time.RFC3339, rotation.IssuedAt)
+	if err != nil {
+		return nil, errors.New("issued_at inválido")
+	}
+
+	result := make([]*Key, 0, len(keys)+len(rotation.Add))
+	for _, key := range keys {
+		updated := *key
+		result = append(result, &updated)
+	}
+
+	for _, entry := range rotation.Add {
+		key, err := ParseKeyEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		key.FromRotation = true
+		replaced := false
+		for i, existing := range result {
+			if existing.ID != key.ID {
+				continue
+			}
+			if !existing.PublicKey.Equal(key.PublicKey) {
+				return nil, fmt.Errorf("el ID %s ya corresponde a otra clave", key.ID)
+			}
+			if key.NotBefore.Before(existing.NotBefore) {
+				key.NotBefore = existing.NotBefore
+			}
+			if !existing.NotAfter.IsZero() && (key.NotAfter.IsZero() || existing.NotAfter.Before(key.NotAfter)) {
+				key.NotAfter = existing.NotAfter
+			}
+			key.FromRotation = existing.FromRotation
+			result[i] = key
+			replaced = true
+		}
+		if !replaced {
+			result = append(result, key)
+		}
+	}
+
+	for _, id := range rotation.Revoke {
+		for _, key := range result {
+			if key.ID == id && (key.NotAfter.IsZero() || issuedAt.Before(key.NotAfter)) {
+				key.NotAfter = issuedAt
+			}
+		}
+	}
+
+	return result, nil
+}
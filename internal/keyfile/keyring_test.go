@@ -0,0 +1,321 @@
+package keyfile
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T, id string) (*Key, ed25519.PrivateKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: id, PublicKey: publicKey}, privateKey
+}
+
+func entryFor(key *Key) *KeyEntry {
+	return &KeyEntry{ID: key.ID, PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey)}
+}
+
+func signRotation(t *testing.T, rotation *KeyRotation, keyID string, privateKey ed25519.PrivateKey) *SignedRotation {
+	t.Helper()
+	rotationJSON, err := json.Marshal(rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SignedRotation{
+		Sequence:  rotation.Sequence,
+		Rotation:  base64.StdEncoding.EncodeToString(rotationJSON),
+		KeyID:     keyID,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, rotationJSON)),
+	}
+}
+
+func TestValidAt(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		key  Key
+		want bool
+	}{
+		{"sin ventana", Key{}, true},
+		{"vigente", Key{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(time.Hour)}, true},
+		{"todavía no", Key{NotBefore: now.Add(time.Hour)}, false},
+		{"vencida", Key{NotAfter: now.Add(-time.Hour)}, false},
+		{"vence justo ahora", Key{NotAfter: now}, false},
+	}
+	for _, test := range tests {
+		if got := test.key.ValidAt(now); got != test.want {
+			t.Errorf("%s: ValidAt = %v, se esperaba %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestVerifyWithKeys(t *testing.T) {
+	a, privateA := newKey(t, "a")
+	b, _ := newKey(t, "b")
+	expired, privateExpired := newKey(t, "expired")
+	expired.NotAfter = time.Now().Add(-time.Minute)
+	keys := []*Key{a, b, expired}
+
+	message := []byte("manifest")
+	verify := func(signature []byte) func(ed25519.PublicKey) bool {
+		return func(publicKey ed25519.PublicKey) bool {
+			return ed25519.Verify(publicKey, message, signature)
+		}
+	}
+	signedA := ed25519.Sign(privateA, message)
+
+	if err := VerifyWithKeys(keys, "a", verify(signedA)); err != nil {
+		t.Errorf("firma de a con key_id a: %v", err)
+	}
+	if err := VerifyWithKeys(keys, "", verify(signedA)); err != nil {
+		t.Errorf("firma de a sin key_id: %v", err)
+	}
+	if err := VerifyWithKeys(keys, "b", verify(signedA)); err == nil {
+		t.Error("la firma de a se aceptó como de b")
+	}
+	if err := VerifyWithKeys(keys, "c", verify(signedA)); err == nil {
+		t.Error("se aceptó una clave desconocida")
+	}
+	if err := VerifyWithKeys(keys, "expired", verify(ed25519.Sign(privateExpired, message))); err == nil {
+		t.Error("se aceptó una clave vencida")
+	}
+	if err := VerifyWithKeys([]*Key{expired}, "", verify(ed25519.Sign(privateExpired, message))); err == nil {
+		t.Error("se aceptó un keyring sin claves vigentes")
+	}
+}
+
+func TestValidSigners(t *testing.T) {
+	a, privateA := newKey(t, "a")
+	b, privateB := newKey(t, "b")
+	c, privateC := newKey(t, "c")
+	c.NotAfter = time.Now().Add(-time.Minute)
+	keys := []*Key{a, b, c}
+
+	message := []byte("manifest")
+	sign := func(id string, privateKey ed25519.PrivateKey) *CoSignature {
+		return &CoSignature{KeyID: id, Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, message))}
+	}
+
+	signatures := []*CoSignature{
+		sign("a", privateA),
+		sign("a", privateA), // repetida
+		sign("b", privateA), // key_id que no corresponde
+		sign("", privateB),  // sin key_id, se busca en todo el keyring
+		sign("c", privateC), // vencida
+		{KeyID: "a", Signature: "no es base64"},
+	}
+	if got, want := ValidSigners(keys, nil, message, signatures), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidSigners = %v, se esperaba %v", got, want)
+	}
+	if got, want := ValidSigners(keys, []string{"b"}, message, signatures), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidSigners con policy = %v, se esperaba %v", got, want)
+	}
+	if got := ValidSigners(keys, nil, []byte("otro manifest"), signatures); len(got) != 0 {
+		t.Errorf("ValidSigners sobre otro mensaje = %v", got)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	a, _ := newKey(t, "a")
+	b, _ := newKey(t, "")
+	dir := t.TempDir()
+
+	write := func(keyring Keyring) string {
+		data, _ := json.Marshal(keyring)
+		path := filepath.Join(dir, "keyring.json")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	withWindow := entryFor(a)
+	withWindow.NotAfter = "2030-01-01T00:00:00Z"
+	keys, err := LoadKeyring(write(Keyring{Keys: []*KeyEntry{withWindow, entryFor(b)}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "a" || keys[1].ID != ID(b.PublicKey) {
+		t.Fatalf("keyring leído: %+v", keys)
+	}
+	if !keys[0].NotAfter.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("not_after = %v", keys[0].NotAfter)
+	}
+
+	if _, err := LoadKeyring(write(Keyring{})); err == nil {
+		t.Error("se aceptó un keyring vacío")
+	}
+	if _, err := LoadKeyring(write(Keyring{Keys: []*KeyEntry{entryFor(a), entryFor(a)}})); err == nil {
+		t.Error("se aceptó un ID repetido")
+	}
+	invalid := entryFor(a)
+	invalid.NotBefore = "mañana"
+	if _, err := LoadKeyring(write(Keyring{Keys: []*KeyEntry{invalid}})); err == nil {
+		t.Error("se aceptó un not_before inválido")
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+	a, privateA := newKey(t, "a")
+	b, privateB := newKey(t, "b")
+	b.NotAfter = time.Now().Add(-time.Minute)
+	keys := []*Key{a, b}
+
+	rotation := &KeyRotation{Sequence: 10, IssuedAt: time.Now().UTC().Format(time.RFC3339), Revoke: []string{"b"}}
+
+	got, err := VerifyRotation(keys, nil, 1, signRotation(t, rotation, "a", privateA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, rotation) {
+		t.Errorf("rotación decodificada %+v, se esperaba %+v", got, rotation)
+	}
+
+	if _, err := VerifyRotation(keys, nil, 1, signRotation(t, rotation, "b", privateB)); err == nil {
+		t.Error("se aceptó una rotación firmada con una clave vencida")
+	}
+	tampered := signRotation(t, rotation, "a", privateA)
+	tampered.Rotation = base64.StdEncoding.EncodeToString([]byte(`{"sequence":10,"issued_at":"2025-01-01T00:00:00Z"}`))
+	if _, err := VerifyRotation(keys, nil, 1, tampered); err == nil {
+		t.Error("se aceptó una rotación modificada")
+	}
+	mismatched := signRotation(t, rotation, "a", privateA)
+	mismatched.Sequence = 11
+	if _, err := VerifyRotation(keys, nil, 1, mismatched); err == nil {
+		t.Error("se aceptó un sequence distinto al firmado")
+	}
+}
+
+func TestVerifyRotationThreshold(t *testing.T) {
+	a, privateA := newKey(t, "a")
+	b, privateB := newKey(t, "b")
+	keys := []*Key{a, b}
+
+	cosign := func(signed *SignedRotation, keyID string, privateKey ed25519.PrivateKey) {
+		rotationJSON, _ := base64.StdEncoding.DecodeString(signed.Rotation)
+		signed.Signatures = append(signed.Signatures, &CoSignature{
+			KeyID:     keyID,
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, rotationJSON)),
+		})
+	}
+
+	// Con una sola clave no alcanza, aunque la rotación agregue claves del
+	// mismo firmante
+	attacker, privateAttacker := newKey(t, "attacker")
+	rotation := &KeyRotation{Sequence: 1, IssuedAt: time.Now().UTC().Format(time.RFC3339), Add: []*KeyEntry{entryFor(attacker)}}
+	signed := signRotation(t, rotation, "a", privateA)
+	if _, err := VerifyRotation(keys, nil, 2, signed); err == nil {
+		t.Fatal("se aceptó una rotación con 1 de 2 firmas")
+	}
+	cosign(signed, "a", privateA)
+	if _, err := VerifyRotation(keys, nil, 2, signed); err == nil {
+		t.Fatal("se contó dos veces la misma clave")
+	}
+	cosign(signed, "b", privateB)
+	if _, err := VerifyRotation(keys, nil, 2, signed); err != nil {
+		t.Fatalf("rotación con 2 de 2 firmas: %v", err)
+	}
+
+	// La clave agregada por la rotación no cuenta para la siguiente sin una
+	// policy que la liste
+	rotated, err := ApplyRotation(keys, rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &KeyRotation{Sequence: 2, IssuedAt: rotation.IssuedAt, Revoke: []string{"b"}}
+	signed = signRotation(t, next, "a", privateA)
+	cosign(signed, "attacker", privateAttacker)
+	if _, err := VerifyRotation(rotated, nil, 2, signed); err == nil {
+		t.Error("una clave agregada por rotación contó para el umbral sin policy")
+	}
+	if _, err := VerifyRotation(rotated, []string{"a", "attacker"}, 2, signed); err != nil {
+		t.Errorf("con la clave en la policy: %v", err)
+	}
+	if _, err := VerifyRotation(rotated, []string{"a", "b"}, 2, signed); err == nil {
+		t.Error("contó una clave fuera de la policy")
+	}
+}
+
+func TestApplyRotation(t *testing.T) {
+	a, _ := newKey(t, "a")
+	b, _ := newKey(t, "b")
+	c, _ := newKey(t, "c")
+	keys := []*Key{a, b}
+
+	issuedAt := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	rotation := &KeyRotation{
+		Sequence: 1,
+		IssuedAt: issuedAt.Format(time.RFC3339),
+		Add:      []*KeyEntry{entryFor(c)},
+		Revoke:   []string{"a"},
+	}
+	result, err := ApplyRotation(keys, rotation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 || result[2].ID != "c" || !result[2].PublicKey.Equal(c.PublicKey) {
+		t.Fatalf("keyring rotado: %+v", result)
+	}
+	if !result[0].NotAfter.Equal(issuedAt) {
+		t.Errorf("la clave retirada vence en %v, se esperaba %v", result[0].NotAfter, issuedAt)
+	}
+	if !a.NotAfter.IsZero() {
+		t.Error("ApplyRotation modificó el keyring original")
+	}
+	if result[0].FromRotation || !result[2].FromRotation {
+		t.Error("solo la clave agregada debería quedar marcada con FromRotation")
+	}
+
+	// Retirar no extiende una clave que ya vencía antes
+	earlier := issuedAt.Add(-time.Hour)
+	result[0].NotAfter = earlier
+	again, err := ApplyRotation(result, &KeyRotation{Sequence: 2, IssuedAt: rotation.IssuedAt, Revoke: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again[0].NotAfter.Equal(earlier) {
+		t.Errorf("retirar de nuevo movió not_after a %v", again[0].NotAfter)
+	}
+
+	// Volver a agregar una clave retirada no la revive ni la extiende
+	revived := entryFor(a)
+	revived.NotAfter = "2099-01-01T00:00:00Z"
+	readded, err := ApplyRotation(result, &KeyRotation{Sequence: 3, IssuedAt: rotation.IssuedAt, Add: []*KeyEntry{revived, entryFor(b)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readded[0].NotAfter.Equal(earlier) {
+		t.Errorf("la clave retirada volvió a valer hasta %v", readded[0].NotAfter)
+	}
+	if len(readded) != 3 || !readded[1].NotAfter.IsZero() {
+		t.Errorf("volver a agregar b cambió el keyring: %+v", readded)
+	}
+
+	// Sí puede acotarla
+	narrowed := entryFor(b)
+	narrowed.NotBefore = "2025-01-01T00:00:00Z"
+	narrowed.NotAfter = "2026-01-01T00:00:00Z"
+	readded, err = ApplyRotation(keys, &KeyRotation{Sequence: 4, IssuedAt: rotation.IssuedAt, Add: []*KeyEntry{narrowed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readded[1].NotBefore.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) || !readded[1].NotAfter.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ventana acotada: %v - %v", readded[1].NotBefore, readded[1].NotAfter)
+	}
+
+	stolen := entryFor(c)
+	stolen.ID = "a"
+	if _, err := ApplyRotation(keys, &KeyRotation{Sequence: 5, IssuedAt: rotation.IssuedAt, Add: []*KeyEntry{stolen}}); err == nil {
+		t.Error("se aceptó otra clave con el ID de una existente")
+	}
+}
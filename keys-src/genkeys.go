@@ -3,55 +3,128 @@ package main
 import (
 	"crypto/ed25519"
 	"encoding/base64"
-	"encoding/pem"
+	"flag"
 	"fmt"
 	"os"
+
+	"github.com/jonathanhecl/gigabot-remote-updater/internal/keyfile"
 )
 
+// minPassphrase es el largo mínimo de la passphrase de una clave cifrada.
+const minPassphrase = 8
+
 func main() {
-	fmt.Println("Generando par de claves Ed25519 para Gigabot Updater...")
+	encrypt := flag.Bool("encrypt", false, "Cifrar la clave privada con una passphrase")
+	encryptKey := flag.String("encrypt-key", "", "Cifrar una clave privada existente (sin generar claves nuevas)")
+	passphraseFD := flag.Int("passphrase-fd", -1, "Leer la passphrase de este file descriptor en vez de pedirla")
+	flag.Parse()
 
-	// Generar par de claves
-	publicKey, privateKey, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error generando claves: %v\n", err)
-		os.Exit(1)
+	if *encryptKey != "" {
+		if err := encryptExisting(*encryptKey, *passphraseFD); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✓ %s cifrada (el deployer pide la passphrase al usarla)\n", *encryptKey)
+		return
 	}
 
-	// Guardar clave privada en formato PEM (PKCS#8)
-	privateKeyBytes := privateKey.Seed()
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: privateKeyBytes,
-	})
+	// Para rotar claves se genera un par con otro nombre
+	// (genkeys deploy2 -> deploy2-private.key y deploy2-public.key)
+	name := "deploy"
+	if flag.NArg() > 0 {
+		name = flag.Arg(0)
+	}
+	privateKeyPath := name + "-private.key"
+	publicKeyPath := name + "-public.key"
 
-	if err := os.WriteFile("deploy-private.key", privateKeyPEM, 0600); err != nil {
-		fmt.Fprintf(os.Stderr, "Error escribiendo clave privada: %v\n", err)
-		os.Exit(1)
+	var passphrase []byte
+	if *encrypt {
+		var err error
+		passphrase, err = newPassphrase(privateKeyPath, *passphraseFD)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	// Guardar clave pública en formato PEM (PKIX)
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PUBLIC KEY",
-		Bytes: publicKey,
-	})
+	fmt.Println("Generando par de claves Ed25519 para Gigabot Updater...")
 
-	if err := os.WriteFile("deploy-public.key", publicKeyPEM, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error escribiendo clave pública: %v\n", err)
+	// PKCS#8 y PKIX estándar, compatibles con OpenSSL (salvo la privada
+	// cifrada, que solo leen estas herramientas). No pisa una clave privada
+	// existente.
+	privateKey, err := keyfile.WriteKeyPair(privateKeyPath, publicKeyPath, passphrase)
+	if err != nil {
+		if os.IsExist(err) {
+			fmt.Fprintf(os.Stderr, "Error: %s ya existe, usar otro nombre o borrarla a mano\n", privateKeyPath)
+		} else {
+			fmt.Fprintf(os.Stderr, "Error generando claves: %v\n", err)
+		}
 		os.Exit(1)
 	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
 
 	fmt.Println("✓ Claves generadas exitosamente:")
-	fmt.Printf("  - deploy-private.key (GUARDAR EN LUGAR SEGURO)\n")
-	fmt.Printf("  - deploy-public.key (distribuir a VPS y Mac)\n")
+	if passphrase != nil {
+		fmt.Printf("  - %s (cifrada con passphrase, GUARDAR EN LUGAR SEGURO)\n", privateKeyPath)
+	} else {
+		fmt.Printf("  - %s (GUARDAR EN LUGAR SEGURO)\n", privateKeyPath)
+	}
+	fmt.Printf("  - %s (distribuir a VPS y Mac)\n", publicKeyPath)
 	fmt.Println()
 	fmt.Println("Información de la clave pública:")
 	fmt.Printf("  Algoritmo: Ed25519\n")
 	fmt.Printf("  Tamaño: %d bytes\n", len(publicKey))
 	fmt.Printf("  Base64: %s\n", base64.StdEncoding.EncodeToString(publicKey))
+	fmt.Printf("  Key ID: %s (default en keyrings y en el deployer)\n", keyfile.ID(publicKey))
 	fmt.Println()
 	fmt.Println("IMPORTANTE:")
 	fmt.Println("  - La clave privada NUNCA debe compartirse o subirse al VPS")
 	fmt.Println("  - Solo la máquina de desarrollo debe tener la clave privada")
 	fmt.Println("  - El VPS y el Mac solo necesitan la clave pública")
 }
+
+func newPassphrase(path string, fd int) ([]byte, error) {
+	passphrase, err := keyfile.ReadPassphrase(fmt.Sprintf("Passphrase para %s: ", path), fd, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) < minPassphrase {
+		return nil, fmt.Errorf("la passphrase debe tener al menos %d caracteres", minPassphrase)
+	}
+	return passphrase, nil
+}
+
+// encryptExisting cifra en el lugar una clave privada sin cifrar, para no
+// tener que rotarla. El archivo nuevo se escribe aparte y se renombra encima.
+func encryptExisting(path string, fd int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if keyfile.IsEncrypted(data) {
+		return fmt.Errorf("%s ya está cifrada", path)
+	}
+	privateKey, err := keyfile.ParsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	passphrase, err := newPassphrase(path, fd)
+	if err != nil {
+		return err
+	}
+	encrypted, err := keyfile.EncryptPrivateKey(privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, encrypted, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
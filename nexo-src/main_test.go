@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathanhecl/gigabot-remote-updater/internal/delta"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	storageDir := t.TempDir()
+	return &Server{
+		storageDir: storageDir,
+		channels:   []string{"stable", "beta"},
+		threshold:  1,
+		revoked:    &revocationList{},
+		devices:    &deviceRegistry{path: filepath.Join(storageDir, "devices.json")},
+	}
+}
+
+// addRelease guarda un artefacto de darwin/arm64 y lo publica en el canal.
+func addRelease(t *testing.T, s *Server, version, channel string, rollout int) {
+	t.Helper()
+	dir := s.artifactDir(version, defaultPlatform)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metadata, _ := json.Marshal(&Metadata{Version: version, Platform: defaultPlatform, Channel: channel})
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "gigabot.bin"), []byte("binario "+version), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publishToChannel(channel, version, false, rollout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientInRollout busca un client_id que entre (o no) en el rollout.
+func clientInRollout(t *testing.T, version string, percentage int, in bool) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		clientID := fmt.Sprintf("cliente-%d", i)
+		if inRollout(clientID, version, percentage) == in {
+			return clientID
+		}
+	}
+	t.Fatalf("ningún cliente con inRollout = %v al %d%%", in, percentage)
+	return ""
+}
+
+func TestInRollout(t *testing.T) {
+	const version = "20260101-120000"
+	tests := []struct {
+		name       string
+		clientID   string
+		percentage int
+		want       bool
+	}{
+		{"100% incluye a todos", "mac-1", 100, true},
+		{"100% incluye a los que no mandan client_id", "", 100, true},
+		{"0% no incluye a nadie", "mac-1", 0, false},
+		{"sin client_id solo al 100%", "", 99, false},
+	}
+	for _, test := range tests {
+		if got := inRollout(test.clientID, version, test.percentage); got != test.want {
+			t.Errorf("%s: inRollout = %v, se esperaba %v", test.name, got, test.want)
+		}
+	}
+
+	in := 0
+	for i := 0; i < 1000; i++ {
+		clientID := fmt.Sprintf("cliente-%d", i)
+		at20 := inRollout(clientID, version, 20)
+		if at20 != inRollout(clientID, version, 20) {
+			t.Fatalf("%s: inRollout no es determinístico", clientID)
+		}
+		if at20 && !inRollout(clientID, version, 50) {
+			t.Errorf("%s: estaba en el rollout al 20%% y quedó fuera al 50%%", clientID)
+		}
+		if at20 {
+			in++
+		}
+	}
+	if in < 150 || in > 250 {
+		t.Errorf("al 20%% entraron %d de 1000 clientes", in)
+	}
+}
+
+func TestDownloadVersionEligibility(t *testing.T) {
+	s := newTestServer(t)
+	addRelease(t, s, "20260101-120000", "stable", 100)
+	addRelease(t, s, "20260201-120000", "stable", 50)
+	addRelease(t, s, "20260301-120000", "beta", 100)
+
+	inside := clientInRollout(t, "20260201-120000", 50, true)
+	outside := clientInRollout(t, "20260201-120000", 50, false)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"versión al 100% del canal", "version=20260101-120000", http.StatusOK},
+		{"dentro del rollout", "version=20260201-120000&client_id=" + inside, http.StatusOK},
+		{"fuera del rollout", "version=20260201-120000&client_id=" + outside, http.StatusNotFound},
+		{"rollout sin client_id", "version=20260201-120000", http.StatusNotFound},
+		{"versión de otro canal", "version=20260301-120000", http.StatusNotFound},
+		{"versión de su canal", "version=20260301-120000&channel=beta", http.StatusOK},
+		{"versión que no existe", "version=20260401-120000", http.StatusNotFound},
+		{"sin version sigue el rollout", "client_id=" + outside, http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.handleDownload(w, httptest.NewRequest(http.MethodGet, "/download?"+test.query, nil))
+		if w.Code != test.want {
+			t.Errorf("%s: HTTP %d, se esperaba %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestDownloadVersionThreshold(t *testing.T) {
+	s := newTestServer(t)
+	s.threshold = 2
+	addRelease(t, s, "20260101-120000", "stable", 100)
+
+	w := httptest.NewRecorder()
+	s.handleDownload(w, httptest.NewRequest(http.MethodGet, "/download?version=20260101-120000", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("versión sin las co-firmas requeridas: HTTP %d, se esperaba 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.handlePatch(w, httptest.NewRequest(http.MethodGet, "/patch?version=20260101-120000&from="+fmt.Sprintf("%064x", 0), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("patch hacia una versión sin co-firmas: HTTP %d, se esperaba 404", w.Code)
+	}
+
+	// El deployer la baja para verificarla antes de co-firmar
+	sum := sha256.Sum256([]byte("token-de-lectura"))
+	s.credentials = []*credential{{name: "cosign", hash: sum[:], scopes: []string{"upload", "read"}}}
+	r := httptest.NewRequest(http.MethodGet, "/download?version=20260101-120000", nil)
+	r.Header.Set("Authorization", "Bearer token-de-lectura")
+	w = httptest.NewRecorder()
+	s.handleDownload(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("credencial con scope read: HTTP %d, se esperaba 200", w.Code)
+	}
+}
+
+// writeArtifact guarda un binario con su metadata (sin publicarlo).
+func writeArtifact(t *testing.T, s *Server, version string, binary []byte) *Metadata {
+	t.Helper()
+	dir := s.artifactDir(version, defaultPlatform)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metadata := &Metadata{Version: version, Platform: defaultPlatform, Checksum: fmt.Sprintf("%x", sha256.Sum256(binary))}
+	metadataJSON, _ := json.Marshal(metadata)
+	if err := os.WriteFile(filepath.Join(dir, "metadata.json"), metadataJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "gigabot.bin"), binary, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func TestBuildPatches(t *testing.T) {
+	source := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(source)
+	target := append(append(append([]byte{}, source[:1000]...), "nuevo"...), source[1000:]...)
+
+	s := newTestServer(t)
+	s.patchFrom = 3
+	s.patchMax = 128 << 10
+	old := writeArtifact(t, s, "20260101-120000", source)
+	metadata := writeArtifact(t, s, "20260201-120000", target)
+
+	s.buildPatches(metadata)
+	if patches := s.loadPatches(metadata.Version, defaultPlatform); len(patches) != 0 {
+		t.Fatalf("binario más grande que patch_max_mb: %d patches", len(patches))
+	}
+
+	s.patchMax = 1 << 20
+	s.buildPatches(metadata)
+	patch, err := s.loadPatch(metadata.Version, defaultPlatform, old.Checksum)
+	if err != nil {
+		t.Fatalf("no se generó el patch: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.patchDir(metadata.Version, defaultPlatform), old.Checksum+".delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != patch.Size || fmt.Sprintf("%x", sha256.Sum256(data)) != patch.Checksum {
+		t.Errorf("tamaño o checksum del patch no coinciden con el .json")
+	}
+	var out bytes.Buffer
+	if err := delta.Apply(bytes.NewReader(data), bytes.NewReader(source), int64(len(source)), old.Checksum, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Errorf("el patch no reconstruye el binario nuevo")
+	}
+}
+
+// addCredential agrega una credencial de API con su token en claro.
+func addCredential(s *Server, name, token string, scopes ...string) {
+	sum := sha256.Sum256([]byte(token))
+	s.credentials = append(s.credentials, &credential{name: name, hash: sum[:], scopes: scopes})
+}
+
+func TestLoadCredentials(t *testing.T) {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("un-token-de-ci-de-mas-de-32-caracteres")))
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"credencial válida", Config{Credentials: []*Credential{{Name: "deploy", TokenSHA256: hash, Scopes: []string{"upload"}}}}, ""},
+		{"token anterior", Config{Token: "un-token-de-ci-de-mas-de-32-caracteres"}, ""},
+		{"sin credenciales", Config{}, "no hay credenciales"},
+		{"token de ejemplo", Config{Token: exampleTokens[0]}, "de ejemplo"},
+		{"token corto", Config{Token: "corto"}, "demasiado corto"},
+		{"hash inválido", Config{Credentials: []*Credential{{Name: "deploy", TokenSHA256: "abc", Scopes: []string{"upload"}}}}, "token_sha256"},
+		{"sin scopes", Config{Credentials: []*Credential{{Name: "deploy", TokenSHA256: hash}}}, "sin scopes"},
+		{"scope desconocido", Config{Credentials: []*Credential{{Name: "deploy", TokenSHA256: hash, Scopes: []string{"write"}}}}, "scope desconocido"},
+		{"nombre repetido", Config{Credentials: []*Credential{
+			{Name: "deploy", TokenSHA256: hash, Scopes: []string{"upload"}},
+			{Name: "deploy", TokenSHA256: hash, Scopes: []string{"read"}},
+		}}, "repetida"},
+	}
+	for _, test := range tests {
+		_, err := loadCredentials(&test.config)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestScopeEnforcement(t *testing.T) {
+	s := newTestServer(t)
+	s.requireToken = true
+	addRelease(t, s, "20260101-120000", "stable", 100)
+	addCredential(s, "deploy", "token-de-upload", "upload")
+	addCredential(s, "release", "token-de-promote", "promote")
+	addCredential(s, "revisor", "token-de-lectura", "upload", "read")
+	addCredential(s, "ops", "token-de-admin", "admin")
+
+	rollout := func(bearer, formToken string) *http.Request {
+		form := url.Values{"version": {"20260101-120000"}, "channel": {"stable"}, "percentage": {"50"}}
+		if formToken != "" {
+			form.Set("token", formToken)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/rollout", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return r
+	}
+	get := func(target, bearer string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return r
+	}
+	upload := func(bearer string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("--x--\r\n"))
+		r.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return r
+	}
+	releases := s.deviceOnly(s.handleReleases, true)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request *http.Request
+		want    int
+	}{
+		{"rollout sin token", s.handleRollout, rollout("", ""), http.StatusUnauthorized},
+		{"rollout con token desconocido", s.handleRollout, rollout("otro-token", ""), http.StatusUnauthorized},
+		{"rollout con scope upload", s.handleRollout, rollout("token-de-upload", ""), http.StatusForbidden},
+		{"rollout con scope promote", s.handleRollout, rollout("token-de-promote", ""), http.StatusOK},
+		{"rollout con admin", s.handleRollout, rollout("token-de-admin", ""), http.StatusOK},
+		{"token en el formulario", s.handleRollout, rollout("", "token-de-promote"), http.StatusUnauthorized},
+		{"upload sin Authorization", s.handleUpload, upload(""), http.StatusUnauthorized},
+		{"upload con scope promote", s.handleUpload, upload("token-de-promote"), http.StatusForbidden},
+		{"releases sin token", releases, get("/releases", ""), http.StatusUnauthorized},
+		{"releases con scope upload", releases, get("/releases", "token-de-upload"), http.StatusForbidden},
+		{"releases con scope promote", releases, get("/releases", "token-de-promote"), http.StatusForbidden},
+		{"releases con scope read", releases, get("/releases", "token-de-lectura"), http.StatusOK},
+		{"releases con admin", releases, get("/releases", "token-de-admin"), http.StatusOK},
+		{"dispositivos con scope read", s.handleDevices, get("/devices", "token-de-lectura"), http.StatusForbidden},
+		{"dispositivos con admin", s.handleDevices, get("/devices", "token-de-admin"), http.StatusOK},
+		{"versión concreta con scope upload", s.handleDownload, get("/download?version=20260101-120000", "token-de-upload"), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		test.handler(w, test.request)
+		if w.Code != test.want {
+			t.Errorf("%s: HTTP %d, se esperaba %d (%s)", test.name, w.Code, test.want, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	// Con legacy_form_token los deployers anteriores siguen entrando
+	s.legacyFormToken = true
+	w := httptest.NewRecorder()
+	s.handleRollout(w, rollout("", "token-de-promote"))
+	if w.Code != http.StatusOK {
+		t.Errorf("token en el formulario con legacy_form_token: HTTP %d, se esperaba 200", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.handleRollout(w, rollout("", "token-de-upload"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("token en el formulario sin el scope: HTTP %d, se esperaba 403", w.Code)
+	}
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	s.requireToken = true
+	addRelease(t, s, "20260101-120000", "stable", 100)
+	addCredential(s, "ops", "token-de-admin", "admin")
+	addCredential(s, "revisor", "token-de-lectura", "upload", "read")
+	download := s.deviceOnly(s.handleDownload, false)
+
+	do := func(handler http.HandlerFunc, method, target, bearer, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	expect := func(step string, w *httptest.ResponseRecorder, want int) {
+		t.Helper()
+		if w.Code != want {
+			t.Fatalf("%s: HTTP %d, se esperaba %d (%s)", step, w.Code, want, strings.TrimSpace(w.Body.String()))
+		}
+	}
+
+	w := do(s.handleDevice, http.MethodPost, "/devices/enroll", "", `{"name": "mac-oficina", "platform": "darwin/arm64", "client_id": "mac-1"}`)
+	expect("registro", w, http.StatusOK)
+	var enrolled struct{ ID, Token, Status string }
+	if err := json.Unmarshal(w.Body.Bytes(), &enrolled); err != nil || enrolled.Token == "" || enrolled.Status != devicePending {
+		t.Fatalf("respuesta del registro: %s (%v)", w.Body.String(), err)
+	}
+	expect("registro con nombre inválido", do(s.handleDevice, http.MethodPost, "/devices/enroll", "", `{"name": "../mac"}`), http.StatusBadRequest)
+
+	expect("dispositivo pendiente", do(download, http.MethodGet, "/download", enrolled.Token, ""), http.StatusUnauthorized)
+	expect("token de dispositivo desconocido", do(download, http.MethodGet, "/download", "otro-token", ""), http.StatusUnauthorized)
+	expect("sin token", do(download, http.MethodGet, "/download", "", ""), http.StatusUnauthorized)
+
+	approve, revoke := "/devices/"+enrolled.ID+"/approve", "/devices/"+enrolled.ID+"/revoke"
+	expect("aprobar sin token", do(s.handleDevice, http.MethodPost, approve, "", ""), http.StatusUnauthorized)
+	expect("aprobar con scope read", do(s.handleDevice, http.MethodPost, approve, "token-de-lectura", ""), http.StatusForbidden)
+	expect("aprobar el token del dispositivo", do(s.handleDevice, http.MethodPost, approve, enrolled.Token, ""), http.StatusUnauthorized)
+	expect("aprobar un dispositivo que no existe", do(s.handleDevice, http.MethodPost, "/devices/no-existe/approve", "token-de-admin", ""), http.StatusNotFound)
+	expect("aprobar", do(s.handleDevice, http.MethodPost, approve, "token-de-admin", ""), http.StatusOK)
+	expect("aprobar dos veces", do(s.handleDevice, http.MethodPost, approve, "token-de-admin", ""), http.StatusConflict)
+
+	expect("dispositivo aprobado", do(download, http.MethodGet, "/download", enrolled.Token, ""), http.StatusOK)
+
+	expect("revocar", do(s.handleDevice, http.MethodPost, revoke, "token-de-admin", ""), http.StatusOK)
+	expect("dispositivo revocado", do(download, http.MethodGet, "/download", enrolled.Token, ""), http.StatusUnauthorized)
+	expect("aprobar un revocado", do(s.handleDevice, http.MethodPost, approve, "token-de-admin", ""), http.StatusConflict)
+
+	// La revocación sobrevive a un reinicio
+	restarted := &deviceRegistry{path: s.devices.path}
+	if err := restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	s.devices = restarted
+	expect("dispositivo revocado después de reiniciar", do(download, http.MethodGet, "/download", enrolled.Token, ""), http.StatusUnauthorized)
+
+	var devices []Device
+	if err := json.Unmarshal(do(s.handleDevices, http.MethodGet, "/devices", "token-de-admin", "").Body.Bytes(), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Status != deviceRevoked || devices[0].TokenSHA256 != "" {
+		t.Errorf("registro de dispositivos: %+v", devices)
+	}
+}
@@ -1,374 +1,2421 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
 	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	mathrand "math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/jonathanhecl/gigabot-remote-updater/internal/delta"
+	"github.com/jonathanhecl/gigabot-remote-updater/internal/keyfile"
 )
 
-type Config struct {
-	VpsHost       string
-	CheckInterval time.Duration
-	GigabotPath   string
-	TempDir       string
+type Config struct {
+	VpsHost       string
+	PublicKeyPath string
+	KeyringPath   string // keyring con varias claves de deploy, además o en vez de PublicKeyPath
+	GigabotPath   string
+	CheckInterval time.Duration
+	Jitter        time.Duration // espera aleatoria extra entre chequeos
+	RetryDelay    time.Duration // espera después de un error consultando a Nexo
+	TempDir       string
+	Platform      string // GOOS/GOARCH que se pide a Nexo
+	Channel       string // Canal de Nexo a seguir (stable, beta, canary)
+	LogFile       string // si se indica, la salida del updater y de Gigabot va a este archivo
+	// Rechazar releases sin manifest firmado (subidas con deployers anteriores)
+	RequireManifest bool
+	// Firmas de claves distintas que necesita una release para instalarse y
+	// qué claves cuentan (IDs; vacío = todas las del keyring)
+	SignatureThreshold int
+	ThresholdKeys      []string
+
+	// Frescura: con TimestampKeyPath (clave pública de timestamp de Nexo) cada
+	// respuesta de /latest tiene que traer un timestamp firmado y vigente. Si
+	// pasa más de MaxStaleness sin uno válido el updater da la alarma y, con
+	// StaleAction "refuse", deja de aceptar actualizaciones de ese servidor.
+	TimestampKeyPath string
+	MaxStaleness     time.Duration
+	StaleAction      string // warn o refuse
+
+	// Conexión con Nexo: CACert reemplaza a las CAs del sistema (Nexo con CA
+	// propia o certificado autofirmado); cada pin es el SHA-256 de la clave
+	// pública (SPKI) de algún certificado de la cadena, que además tiene que
+	// ser válida. ClientCert/ClientKey se presentan si Nexo los pide.
+	CACert     string
+	Pins       [][]byte
+	ClientCert string
+	ClientKey  string
+	// Token de dispositivo del registro de Nexo. Si el archivo no existe el
+	// updater se registra y lo guarda; sirve cuando un admin lo aprueba.
+	DeviceTokenPath string
+	DeviceName      string // default: hostname
+
+	// Cómo se lanza Gigabot
+	Args        []string
+	Env         []string // KEY=VALUE que se agregan al entorno del updater
+	EnvFile     string   // archivo KEY=VALUE que se lee en cada inicio
+	SecretsFile string   // igual que EnvFile, pero no puede ser legible por otros
+	WorkingDir  string
+	User        string // usuario con el que corre Gigabot (requiere root)
+	Umask       int    // -1 = heredar la del updater
+
+	// Período de prueba después de cada actualización. Si la versión nueva
+	// se cae o no pasa los chequeos se restaura la anterior.
+	ProbationWindow time.Duration
+	HealthURL       string // GET que debe responder 2xx al final del período
+	ReadyFile       string // archivo que Gigabot crea cuando está listo
+	ReadyMarker     string // texto que Gigabot imprime en stdout/stderr cuando está listo
+
+	// Supervisión: si Gigabot termina se reinicia enseguida y, si vuelve a
+	// caerse, con espera exponencial entre RestartDelay y MaxRestartDelay.
+	// Más de MaxRestarts caídas dentro de CrashWindow es un crash loop: si la
+	// versión se instaló hace menos de RollbackWindow se vuelve a la anterior,
+	// si no se deja de reiniciar hasta que pase la ventana.
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+	MaxRestarts     int
+	CrashWindow     time.Duration
+	RollbackWindow  time.Duration
+
+	// Apagado: primero el hook pre-stop (POST a PreStopURL y/o PreStopCommand)
+	// para que Gigabot termine lo que está haciendo, después StopSignal a
+	// todo el grupo de procesos y, pasado StopTimeout, SIGKILL.
+	StopSignal     syscall.Signal
+	StopTimeout    time.Duration
+	PreStopURL     string
+	PreStopCommand string
+	PreStopTimeout time.Duration
+	PostStopDelay  time.Duration // espera antes de reemplazar el binario
+}
+
+func defaultConfig() Config {
+	return Config{
+		CheckInterval: 5 * time.Minute,
+		RetryDelay:    1 * time.Minute,
+		TempDir:       os.TempDir(),
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+		Channel:       "stable",
+		Umask:         -1,
+
+		SignatureThreshold: 1,
+
+		MaxStaleness: 24 * time.Hour,
+		StaleAction:  "warn",
+
+		ProbationWindow: 30 * time.Second,
+
+		RestartDelay:    time.Second,
+		MaxRestartDelay: time.Minute,
+		MaxRestarts:     5,
+		CrashWindow:     5 * time.Minute,
+		RollbackWindow:  10 * time.Minute,
+
+		StopSignal:     syscall.SIGINT,
+		StopTimeout:    10 * time.Second,
+		PreStopTimeout: 30 * time.Second,
+		PostStopDelay:  2 * time.Second,
+	}
+}
+
+// option describe una opción del updater. Cada una se puede indicar en el
+// archivo de configuración (clave en snake_case), como variable de entorno
+// (GIGABOT_ + clave en mayúsculas) o como flag. Prioridad de menor a mayor:
+// default, archivo, entorno, flags.
+type option struct {
+	name  string // nombre del flag
+	key   string // clave en el JSON (default: name con _ en vez de -)
+	usage string
+	list  bool // se puede repetir; en el entorno se separa por espacios
+	flag  bool // sí/no: como flag alcanza con -nombre
+	set   func(c *Config, value string) error
+}
+
+func (o option) jsonKey() string {
+	if o.key != "" {
+		return o.key
+	}
+	return strings.ReplaceAll(o.name, "-", "_")
+}
+
+func (o option) envVar() string {
+	return "GIGABOT_" + strings.ToUpper(o.jsonKey())
+}
+
+func stringOption(name, usage string, field func(c *Config) *string) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func durationOption(name, usage string, field func(c *Config) *time.Duration) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("duración negativa")
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+var options = []option{
+	stringOption("vps-host", "URL de Nexo (ej: https://tu-vps:8443)", func(c *Config) *string { return &c.VpsHost }),
+	stringOption("public-key", "Archivo de clave pública", func(c *Config) *string { return &c.PublicKeyPath }),
+	stringOption("keyring", "Keyring JSON con las claves de deploy de confianza (además o en vez de -public-key)", func(c *Config) *string { return &c.KeyringPath }),
+	stringOption("gigabot-path", "Ruta al binario de Gigabot", func(c *Config) *string { return &c.GigabotPath }),
+	stringOption("channel", "Canal de Nexo a seguir (stable, beta, canary)", func(c *Config) *string { return &c.Channel }),
+	stringOption("platform", "Plataforma a pedir a Nexo (default: la del updater)", func(c *Config) *string { return &c.Platform }),
+	durationOption("check-interval", "Intervalo entre chequeos", func(c *Config) *time.Duration { return &c.CheckInterval }),
+	durationOption("jitter", "Espera aleatoria extra entre chequeos (0 a este valor)", func(c *Config) *time.Duration { return &c.Jitter }),
+	durationOption("retry-delay", "Espera después de un error consultando a Nexo", func(c *Config) *time.Duration { return &c.RetryDelay }),
+	stringOption("temp-dir", "Directorio para descargas temporales", func(c *Config) *string { return &c.TempDir }),
+	{name: "require-manifest", flag: true, usage: "Rechazar releases sin manifest firmado", set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("se esperaba true o false")
+		}
+		c.RequireManifest = b
+		return nil
+	}},
+	{name: "signature-threshold", usage: "Firmas de claves distintas que necesita una release o una rotación de claves (m de n)", set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("se esperaba un entero >= 1")
+		}
+		c.SignatureThreshold = n
+		return nil
+	}},
+	{name: "threshold-key", key: "threshold_keys", usage: "ID de clave que cuenta para -signature-threshold (repetible; default: las del keyring, sin las agregadas por rotaciones)", list: true, set: func(c *Config, value string) error {
+		c.ThresholdKeys = append(c.ThresholdKeys, value)
+		return nil
+	}},
+	stringOption("timestamp-key", "Clave pública de timestamp de Nexo (activa el chequeo de frescura)", func(c *Config) *string { return &c.TimestampKeyPath }),
+	durationOption("max-staleness", "Alarma si la última metadata con timestamp válido es más vieja que esto", func(c *Config) *time.Duration { return &c.MaxStaleness }),
+	{name: "stale-action", usage: "Qué hacer con metadata vieja: warn (solo alarma) o refuse (no actualizar)", set: func(c *Config, value string) error {
+		if value != "warn" && value != "refuse" {
+			return fmt.Errorf("se esperaba warn o refuse")
+		}
+		c.StaleAction = value
+		return nil
+	}},
+	stringOption("ca-cert", "Certificados de CA (PEM) en los que confiar para Nexo, en vez de los del sistema", func(c *Config) *string { return &c.CACert }),
+	{name: "pin", key: "pins", usage: "SHA-256 en base64 de la clave pública (SPKI) de un certificado de la cadena de Nexo (repetible)", list: true, set: func(c *Config, value string) error {
+		pin, err := parsePin(value)
+		if err != nil {
+			return err
+		}
+		c.Pins = append(c.Pins, pin)
+		return nil
+	}},
+	stringOption("client-cert", "Certificado de cliente (PEM) para Nexo", func(c *Config) *string { return &c.ClientCert }),
+	stringOption("client-key", "Clave del certificado de cliente (PEM)", func(c *Config) *string { return &c.ClientKey }),
+	stringOption("device-token", "Archivo con el token de dispositivo de Nexo (si no existe, el updater se registra)", func(c *Config) *string { return &c.DeviceTokenPath }),
+	stringOption("device-name", "Nombre con el que se registra el dispositivo (default: hostname)", func(c *Config) *string { return &c.DeviceName }),
+	stringOption("log-file", "Archivo donde escribir la salida del updater y de Gigabot", func(c *Config) *string { return &c.LogFile }),
+	{name: "arg", key: "args", usage: "Argumento para Gigabot (repetible)", list: true, set: func(c *Config, value string) error {
+		c.Args = append(c.Args, value)
+		return nil
+	}},
+	{name: "env", usage: "Variable KEY=VALUE para Gigabot (repetible)", list: true, set: func(c *Config, value string) error {
+		if !strings.Contains(value, "=") {
+			return fmt.Errorf("se esperaba KEY=VALUE")
+		}
+		c.Env = append(c.Env, value)
+		return nil
+	}},
+	stringOption("env-file", "Archivo KEY=VALUE con variables para Gigabot", func(c *Config) *string { return &c.EnvFile }),
+	stringOption("secrets-file", "Archivo KEY=VALUE con secretos para Gigabot (permisos 0600)", func(c *Config) *string { return &c.SecretsFile }),
+	stringOption("working-dir", "Directorio de trabajo de Gigabot", func(c *Config) *string { return &c.WorkingDir }),
+	stringOption("user", "Usuario con el que corre Gigabot (el updater debe correr como root)", func(c *Config) *string { return &c.User }),
+	{name: "umask", usage: "Umask en octal para Gigabot (ej: 027)", set: func(c *Config, value string) error {
+		mask, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mask > 0777 {
+			return fmt.Errorf("se esperaba un umask en octal")
+		}
+		c.Umask = int(mask)
+		return nil
+	}},
+	durationOption("probation", "Período de prueba después de actualizar (0 lo desactiva)", func(c *Config) *time.Duration { return &c.ProbationWindow }),
+	stringOption("health-url", "URL que debe responder 2xx durante el período de prueba", func(c *Config) *string { return &c.HealthURL }),
+	stringOption("ready-file", "Archivo que Gigabot crea cuando está listo", func(c *Config) *string { return &c.ReadyFile }),
+	stringOption("ready-marker", "Texto que Gigabot imprime cuando está listo", func(c *Config) *string { return &c.ReadyMarker }),
+	durationOption("restart-delay", "Espera inicial entre reinicios después de una caída", func(c *Config) *time.Duration { return &c.RestartDelay }),
+	durationOption("max-restart-delay", "Espera máxima entre reinicios", func(c *Config) *time.Duration { return &c.MaxRestartDelay }),
+	{name: "max-restarts", usage: "Caídas dentro de -crash-window que se consideran crash loop (0 = sin límite)", set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("se esperaba un entero >= 0")
+		}
+		c.MaxRestarts = n
+		return nil
+	}},
+	durationOption("crash-window", "Ventana para contar caídas", func(c *Config) *time.Duration { return &c.CrashWindow }),
+	durationOption("rollback-window", "Un crash loop dentro de este tiempo después de actualizar vuelve a la versión anterior", func(c *Config) *time.Duration { return &c.RollbackWindow }),
+	{name: "stop-signal", usage: "Señal para detener Gigabot (SIGINT, SIGTERM, SIGHUP, SIGQUIT, SIGUSR1, SIGUSR2)", set: func(c *Config, value string) error {
+		sig, ok := stopSignals[strings.TrimPrefix(strings.ToUpper(value), "SIG")]
+		if !ok {
+			return fmt.Errorf("señal desconocida")
+		}
+		c.StopSignal = sig
+		return nil
+	}},
+	durationOption("stop-timeout", "Espera después de la señal antes de forzar kill", func(c *Config) *time.Duration { return &c.StopTimeout }),
+	stringOption("pre-stop-url", "URL a la que se hace POST antes de detener Gigabot (ej: http://127.0.0.1:8080/drain)", func(c *Config) *string { return &c.PreStopURL }),
+	stringOption("pre-stop-command", "Comando (sh -c) que se ejecuta antes de detener Gigabot", func(c *Config) *string { return &c.PreStopCommand }),
+	durationOption("pre-stop-timeout", "Tiempo máximo del hook pre-stop", func(c *Config) *time.Duration { return &c.PreStopTimeout }),
+	durationOption("post-stop-delay", "Espera después de detener Gigabot antes de reemplazar el binario", func(c *Config) *time.Duration { return &c.PostStopDelay }),
+}
+
+// optionValue es un valor de opción leído de alguna fuente.
+type optionValue struct {
+	opt   option
+	value string
+}
+
+// applyOptions aplica los valores de una fuente. Las opciones repetibles
+// reemplazan la lista de fuentes anteriores en vez de sumarse.
+func applyOptions(c *Config, source string, values []optionValue) error {
+	cleared := map[string]bool{}
+	for _, v := range values {
+		if v.opt.list && !cleared[v.opt.name] {
+			cleared[v.opt.name] = true
+			switch v.opt.name {
+			case "arg":
+				c.Args = nil
+			case "env":
+				c.Env = nil
+			case "threshold-key":
+				c.ThresholdKeys = nil
+			case "pin":
+				c.Pins = nil
+			}
+		}
+		if err := v.opt.set(c, v.value); err != nil {
+			return fmt.Errorf("%s: opción %s=%q: %w", source, v.opt.name, v.value, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile lee el archivo JSON de configuración del updater. Otras
+// extensiones (un updater.yaml, por ejemplo) se rechazan con un error claro
+// en vez de fallar al parsearlas como JSON.
+func readConfigFile(path string) ([]optionValue, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		return nil, fmt.Errorf("formato de configuración no soportado %q: solo JSON (.json), YAML no está soportado", ext)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	var values []optionValue
+	for _, opt := range options {
+		value, ok := raw[opt.jsonKey()]
+		if !ok {
+			continue
+		}
+		delete(raw, opt.jsonKey())
+
+		switch v := value.(type) {
+		case []interface{}:
+			if !opt.list {
+				return nil, fmt.Errorf("%s no acepta una lista", opt.jsonKey())
+			}
+			for _, item := range v {
+				values = append(values, optionValue{opt, fmt.Sprint(item)})
+			}
+		case map[string]interface{}:
+			// "env": {"KEY": "VALUE"}
+			if opt.name != "env" {
+				return nil, fmt.Errorf("%s no acepta un objeto", opt.jsonKey())
+			}
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				values = append(values, optionValue{opt, k + "=" + fmt.Sprint(v[k])})
+			}
+		case float64:
+			values = append(values, optionValue{opt, strconv.FormatFloat(v, 'f', -1, 64)})
+		default:
+			values = append(values, optionValue{opt, fmt.Sprint(v)})
+		}
+	}
+
+	for key := range raw {
+		return nil, fmt.Errorf("opción desconocida %q", key)
+	}
+	return values, nil
+}
+
+func envOptions() []optionValue {
+	var values []optionValue
+	for _, opt := range options {
+		value, ok := os.LookupEnv(opt.envVar())
+		if !ok || value == "" {
+			continue
+		}
+		if opt.list {
+			for _, item := range strings.Fields(value) {
+				values = append(values, optionValue{opt, item})
+			}
+			continue
+		}
+		values = append(values, optionValue{opt, value})
+	}
+	return values
+}
+
+// flagOption registra los flags en orden para aplicarlos después del
+// archivo y del entorno.
+type flagOption struct {
+	opt    option
+	values *[]optionValue
+}
+
+func (f flagOption) String() string { return "" }
+
+func (f flagOption) IsBoolFlag() bool { return f.opt.flag }
+
+func (f flagOption) Set(value string) error {
+	*f.values = append(*f.values, optionValue{f.opt, value})
+	return nil
+}
+
+type Metadata struct {
+	Version   string `json:"version"`
+	BuildTime string `json:"build_time"`
+	Checksum  string `json:"checksum"`
+	Platform  string `json:"platform"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id,omitempty"` // clave del keyring que firmó
+	// ed25519ph o vacío (Ed25519 sobre el binario completo, releases viejas)
+	SignatureAlg string   `json:"signature_alg,omitempty"`
+	Patches      []*Patch `json:"patches,omitempty"`
+	// Manifest firmado por el deployer (JSON en base64) y su firma
+	Manifest          string `json:"manifest,omitempty"`
+	ManifestSignature string `json:"manifest_signature,omitempty"`
+	// Co-firmas del manifest de otras claves del keyring
+	Signatures []*keyfile.CoSignature `json:"signatures,omitempty"`
+	// Timestamp firmado por Nexo para esta respuesta (JSON en base64)
+	Timestamp          string `json:"timestamp,omitempty"`
+	TimestampSignature string `json:"timestamp_signature,omitempty"`
+
+	size int64 // tamaño del binario según el manifest, -1 si no hay manifest
+}
+
+// Manifest son los datos de la release firmados por el deployer. Cuando
+// está, versión, plataforma y checksum salen de acá y no de lo que diga
+// Nexo.
+type Manifest struct {
+	Version   string `json:"version"`
+	Platform  string `json:"platform"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+	BuildTime string `json:"build_time"`
+	Expires   string `json:"expires"`
+}
+
+// Timestamp es la prueba de frescura que firma Nexo en cada respuesta de
+// /latest, con una clave propia y un vencimiento corto.
+type Timestamp struct {
+	Channel  string `json:"channel"`
+	Platform string `json:"platform"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+	IssuedAt string `json:"issued_at"`
+	Expires  string `json:"expires"`
+}
+
+// Patch es un delta que Nexo ofrece desde una versión anterior. Solo sirve
+// si el binario instalado tiene exactamente FromChecksum.
+type Patch struct {
+	FromVersion  string `json:"from_version"`
+	FromChecksum string `json:"from_checksum"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum"`
+}
+
+// State es lo que el updater recuerda entre reinicios sobre el binario
+// instalado. Se guarda en .gigabot-state.json junto al binario de Gigabot.
+type State struct {
+	Version          string `json:"version"`
+	Checksum         string `json:"checksum"`
+	InstalledAt      string `json:"installed_at"`
+	PreviousVersion  string `json:"previous_version,omitempty"`
+	PreviousChecksum string `json:"previous_checksum,omitempty"`
+	// Última versión que no pasó el período de prueba; no se reintenta
+	FailedVersion  string `json:"failed_version,omitempty"`
+	FailedChecksum string `json:"failed_checksum,omitempty"`
+	// issued_at del último timestamp válido de Nexo; uno anterior es una
+	// respuesta repetida
+	LastTimestamp string `json:"last_timestamp,omitempty"`
+	// Ya se instaló una release con manifest firmado. Desde entonces no se
+	// aceptan releases sin manifest: su versión no está firmada y Nexo
+	// podría hacer pasar una build vieja por una nueva.
+	ManifestInstalled bool `json:"manifest_installed,omitempty"`
+}
+
+type Updater struct {
+	config       Config
+	keys         []*keyfile.Key
+	keysPath     string                    // rotaciones aprendidas de Nexo
+	rotations    []*keyfile.SignedRotation // ya aplicadas a keys
+	timestampKey ed25519.PublicKey         // nil: sin chequeo de frescura
+	transport    *http.Transport           // TLS hacia Nexo (CA, pins, certificado de cliente)
+	device       *deviceAuth               // nil: sin token de dispositivo
+	startedAt    time.Time
+	clientID     string // identidad estable para los rollouts por porcentaje
+	statePath    string
+	state        State
+	currentVer   string
+
+	// updateMu serializa el chequeo/actualización con el rollback que dispara
+	// el supervisor al detectar un crash loop.
+	updateMu sync.Mutex
+
+	// mu protege el estado del proceso supervisado
+	mu             sync.Mutex
+	gigabotCmd     *exec.Cmd
+	gigabotDone    chan struct{} // se cierra cuando termina el proceso actual
+	readyMarker    *markerWriter // detecta ReadyMarker en la salida del proceso actual
+	stopping       bool          // el proceso se detuvo a propósito, no reiniciar
+	inProbation    bool          // las caídas las maneja probation, no el supervisor
+	restartPending bool
+	crashes        []time.Time // caídas dentro de CrashWindow
+	crashLoop      bool
+}
+
+func main() {
+	var flagValues []optionValue
+	configPath := flag.String("config", "", "Archivo de configuración JSON (default: updater.json si existe)")
+	for _, opt := range options {
+		flag.Var(flagOption{opt, &flagValues}, opt.name, opt.usage)
+	}
+	flag.Usage = func() {
+		fmt.Println("Uso: updater-mac [opciones] [<vps-host> <public-key-file> <gigabot-path>]")
+		fmt.Println("Ejemplo: updater-mac https://tu-vps.com:8443 deploy-public.key ./gigabot")
+		fmt.Println("         updater-mac -config updater.json")
+		fmt.Println("")
+		fmt.Println("Opciones (también en el archivo de configuración y como variables GIGABOT_*):")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config := defaultConfig()
+
+	if *configPath == "" {
+		*configPath = os.Getenv("GIGABOT_UPDATER_CONFIG")
+	}
+	if *configPath == "" {
+		if _, err := os.Stat("updater.json"); err == nil {
+			*configPath = "updater.json"
+		}
+	}
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error leyendo %s: %v\n", *configPath, err)
+			os.Exit(1)
+		}
+		if err := applyOptions(&config, *configPath, values); err != nil {
+			fmt.Fprintf(os.Stderr, "Error en configuración: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := applyOptions(&config, "entorno", envOptions()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error en configuración: %v\n", err)
+		os.Exit(1)
+	}
+	if err := applyOptions(&config, "flags", flagValues); err != nil {
+		fmt.Fprintf(os.Stderr, "Error en configuración: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Compatibilidad con la forma original: tres argumentos posicionales
+	switch flag.NArg() {
+	case 0:
+	case 3:
+		config.VpsHost = flag.Arg(0)
+		config.PublicKeyPath = flag.Arg(1)
+		config.GigabotPath = flag.Arg(2)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if config.VpsHost == "" || (config.PublicKeyPath == "" && config.KeyringPath == "") || config.GigabotPath == "" {
+		fmt.Fprintln(os.Stderr, "Faltan vps-host, public-key o gigabot-path")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if config.LogFile != "" {
+		logFile, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error abriendo log: %v\n", err)
+			os.Exit(1)
+		}
+		os.Stdout = logFile
+		os.Stderr = logFile
+	}
+
+	var keys []*keyfile.Key
+	if config.KeyringPath != "" {
+		var err error
+		keys, err = keyfile.LoadKeyring(config.KeyringPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error cargando keyring: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if config.PublicKeyPath != "" {
+		publicKeyPEM, err := os.ReadFile(config.PublicKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error leyendo clave pública: %v\n", err)
+			os.Exit(1)
+		}
+
+		publicKey, err := keyfile.ParsePublicKey(publicKeyPEM)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parseando clave pública: %v\n", err)
+			os.Exit(1)
+		}
+		// Si la clave ya está en el keyring manda su ventana de validez
+		inKeyring := false
+		for _, key := range keys {
+			inKeyring = inKeyring || key.PublicKey.Equal(publicKey)
+		}
+		if !inKeyring {
+			keys = append(keys, &keyfile.Key{ID: keyfile.ID(publicKey), PublicKey: publicKey})
+		}
+	}
+
+	var timestampKey ed25519.PublicKey
+	if config.TimestampKeyPath != "" {
+		timestampKeyPEM, err := os.ReadFile(config.TimestampKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error leyendo clave de timestamp: %v\n", err)
+			os.Exit(1)
+		}
+		timestampKey, err = keyfile.ParsePublicKey(timestampKeyPEM)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parseando clave de timestamp: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configurando TLS: %v\n", err)
+		os.Exit(1)
+	}
+
+	gigabotDir := filepath.Dir(config.GigabotPath)
+	clientID, err := loadClientID(filepath.Join(gigabotDir, ".gigabot-client-id"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error cargando client ID: %v\n", err)
+		os.Exit(1)
+	}
+
+	updater := &Updater{
+		config:       config,
+		keys:         keys,
+		keysPath:     filepath.Join(gigabotDir, ".gigabot-keys.json"),
+		timestampKey: timestampKey,
+		transport:    transport,
+		startedAt:    time.Now(),
+		clientID:     clientID,
+		statePath:    filepath.Join(gigabotDir, ".gigabot-state.json"),
+		currentVer:   "",
+	}
+
+	if config.DeviceTokenPath != "" {
+		token, err := os.ReadFile(config.DeviceTokenPath)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error leyendo token de dispositivo: %v\n", err)
+			os.Exit(1)
+		}
+		updater.device = &deviceAuth{base: transport, token: strings.TrimSpace(string(token))}
+	}
+
+	if err := updater.reconcileState(); err != nil {
+		fmt.Printf("Advertencia: no se pudo leer el estado local: %v\n", err)
+	}
+	if err := updater.loadRotations(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error cargando rotaciones de claves: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Updater Mac iniciado")
+	fmt.Printf("VPS: %s\n", updater.config.VpsHost)
+	fmt.Printf("Plataforma: %s\n", updater.config.Platform)
+	fmt.Printf("Canal: %s\n", updater.config.Channel)
+	fmt.Printf("Client ID: %s\n", updater.clientID)
+	fmt.Printf("Gigabot: %s\n", updater.config.GigabotPath)
+	fmt.Printf("Claves de deploy: %s\n", strings.Join(keyfile.KeyIDs(updater.keys), ", "))
+	if config.CACert != "" {
+		fmt.Printf("CA de Nexo: %s\n", config.CACert)
+	}
+	if len(config.Pins) > 0 {
+		fmt.Printf("Pins de Nexo: %d\n", len(config.Pins))
+	}
+	if config.ClientCert != "" {
+		fmt.Printf("Certificado de cliente: %s\n", config.ClientCert)
+	}
+	if config.DeviceTokenPath != "" {
+		fmt.Printf("Token de dispositivo: %s\n", config.DeviceTokenPath)
+	}
+	if updater.currentVer != "" {
+		fmt.Printf("Versión instalada: %s\n", updater.currentVer)
+	}
+	fmt.Printf("Intervalo de chequeo: %s\n", updater.config.CheckInterval)
+	if updater.config.Jitter > 0 {
+		fmt.Printf("Jitter: hasta %s\n", updater.config.Jitter)
+	}
+	if updater.config.ProbationWindow > 0 {
+		fmt.Printf("Período de prueba: %s\n", updater.config.ProbationWindow)
+	}
+	if updater.config.SignatureThreshold > 1 {
+		fmt.Printf("Firmas requeridas por release: %d\n", updater.config.SignatureThreshold)
+	}
+
+	// Gigabot corre en su propio grupo de procesos, así que Ctrl+C o el
+	// SIGTERM de launchd/systemd no le llegan: se detiene desde acá.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("Recibida señal %s, deteniendo Gigabot...\n", sig)
+		updater.stopGigabot()
+		os.Exit(0)
+	}()
+
+	if err := updater.run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error fatal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (u *Updater) run() error {
+	for {
+		wait := u.runOnce()
+		if u.config.Jitter > 0 {
+			// Evita que todos los updaters consulten a Nexo en el mismo instante
+			wait += time.Duration(mathrand.Int63n(int64(u.config.Jitter)))
+		}
+		time.Sleep(wait)
+	}
+}
+
+// runOnce hace un chequeo (y la actualización si corresponde) y devuelve
+// cuánto esperar hasta el siguiente.
+func (u *Updater) runOnce() time.Duration {
+	u.updateMu.Lock()
+	defer u.updateMu.Unlock()
+
+	if u.device != nil && !u.device.enrolled() {
+		if err := u.enroll(); err != nil {
+			fmt.Printf("Advertencia: no se pudo registrar el dispositivo en Nexo: %v\n", err)
+		}
+	}
+
+	if err := u.refreshKeys(); err != nil {
+		fmt.Printf("Advertencia: no se pudieron actualizar las claves de deploy: %v\n", err)
+	}
+
+	needsUpdate, metadata, err := u.checkUpdate()
+	u.checkFreshness()
+	if err != nil {
+		fmt.Printf("Error chequeando actualización: %v\n", err)
+		// Sin VPS igual hay que mantener vivo el Gigabot que ya está instalado
+		if _, statErr := os.Stat(u.config.GigabotPath); statErr == nil {
+			u.ensureRunning()
+		}
+		if errors.Is(err, errRejected) {
+			// Reintentar enseguida no cambia nada, Nexo va a ofrecer lo mismo
+			return u.config.CheckInterval
+		}
+		fmt.Printf("Reintentando en %s...\n", u.config.RetryDelay)
+		return u.config.RetryDelay
+	}
+
+	if !needsUpdate {
+		fmt.Printf("Versión actual (%s) es la última. Esperando...\n", u.currentVer)
+		u.ensureRunning()
+		return u.config.CheckInterval
+	}
+
+	fmt.Printf("Nueva versión disponible: %s (actual: %s)\n", metadata.Version, u.currentVer)
+
+	if err := u.downloadAndUpdate(metadata); err != nil {
+		fmt.Printf("Error actualizando: %v\n", err)
+		if errors.Is(err, errDownload) {
+			// La descarga parcial queda guardada y se retoma en el próximo intento
+			fmt.Printf("Reintentando en %s...\n", u.config.RetryDelay)
+			return u.config.RetryDelay
+		}
+		return u.config.CheckInterval
+	}
+
+	u.recordInstall(metadata)
+	fmt.Printf("Actualización a %s completada exitosamente\n", metadata.Version)
+
+	return u.config.CheckInterval
+}
+
+var errRejected = errors.New("release rechazada")
+
+// verifyTimestamp verifica el timestamp que firma Nexo en cada respuesta de
+// /latest: firma, vigencia, que corresponda a esta respuesta y que no sea
+// anterior al último visto. Si es válido lo recuerda como el más reciente.
+func (u *Updater) verifyTimestamp(metadata *Metadata) error {
+	if metadata.Timestamp == "" {
+		return fmt.Errorf("la respuesta no trae timestamp")
+	}
+	timestampJSON, err := base64.StdEncoding.DecodeString(metadata.Timestamp)
+	if err != nil {
+		return fmt.Errorf("timestamp en base64 inválido")
+	}
+	signature, err := base64.StdEncoding.DecodeString(metadata.TimestampSignature)
+	if err != nil {
+		return fmt.Errorf("firma del timestamp en base64 inválida")
+	}
+	if !ed25519.Verify(u.timestampKey, timestampJSON, signature) {
+		return fmt.Errorf("firma del timestamp inválida")
+	}
+
+	var timestamp Timestamp
+	if err := json.Unmarshal(timestampJSON, &timestamp); err != nil {
+		return fmt.Errorf("timestamp ilegible: %w", err)
+	}
+	if timestamp.Channel != u.config.Channel || timestamp.Platform != metadata.Platform ||
+		timestamp.Version != metadata.Version || timestamp.Checksum != metadata.Checksum {
+		return fmt.Errorf("el timestamp es de otra respuesta")
+	}
+
+	issuedAt, err := time.Parse(time.RFC3339, timestamp.IssuedAt)
+	if err != nil {
+		return fmt.Errorf("issued_at inválido")
+	}
+	expires, err := time.Parse(time.RFC3339, timestamp.Expires)
+	if err != nil {
+		return fmt.Errorf("expires inválido")
+	}
+	now := time.Now()
+	if now.After(expires) {
+		return fmt.Errorf("timestamp vencido el %s (respuesta repetida o reloj atrasado)", timestamp.Expires)
+	}
+	if issuedAt.After(now.Add(5 * time.Minute)) {
+		return fmt.Errorf("timestamp emitido en el futuro (%s), revisar el reloj", timestamp.IssuedAt)
+	}
+	if last, err := time.Parse(time.RFC3339, u.state.LastTimestamp); err == nil && issuedAt.Before(last) {
+		return fmt.Errorf("timestamp anterior al último visto (%s)", u.state.LastTimestamp)
+	}
+
+	u.state.LastTimestamp = timestamp.IssuedAt
+	if err := u.saveState(); err != nil {
+		fmt.Printf("Advertencia: no se pudo guardar el estado local: %v\n", err)
+	}
+	return nil
+}
+
+// staleness es cuánto pasó desde el último timestamp válido de Nexo, que
+// queda en el estado local. Solo si nunca vio ninguno cuenta desde que
+// arrancó el updater: reiniciarlo no vuelve a poner la cuenta en cero.
+func (u *Updater) staleness() time.Duration {
+	if t, err := time.Parse(time.RFC3339, u.state.LastTimestamp); err == nil {
+		return time.Since(t)
+	}
+	return time.Since(u.startedAt)
+}
+
+// checkFreshness da la alarma si hace más de MaxStaleness que no llega
+// metadata fresca: Nexo caído, un intermediario repitiendo respuestas viejas
+// o un servidor comprometido que congela al Mac en una versión.
+func (u *Updater) checkFreshness() {
+	if u.timestampKey == nil {
+		return
+	}
+	age := u.staleness()
+	if age <= u.config.MaxStaleness {
+		return
+	}
+	err := fmt.Errorf("la última metadata válida de Nexo es de hace %s (máximo %s)", age.Round(time.Minute), u.config.MaxStaleness)
+	fmt.Printf("ALERTA: %v\n", err)
+	if u.currentVer != "" {
+		u.report(&Metadata{Version: u.currentVer, Platform: u.config.Platform}, "stale", err)
+	}
+}
+
+// verifyManifest verifica el manifest firmado de la release y que la
+// metadata de Nexo coincida con él. Sin manifest solo se acepta si
+// RequireManifest está desactivado y nunca se instaló una release con
+// manifest (ver State.ManifestInstalled). Con installed (Nexo ofrece el
+// binario que ya está instalado) no se mira el vencimiento.
+func (u *Updater) verifyManifest(metadata *Metadata, installed bool) error {
+	metadata.size = -1
+	if metadata.Manifest == "" {
+		if u.config.RequireManifest || u.config.SignatureThreshold > 1 {
+			return fmt.Errorf("la versión %s no tiene manifest firmado", metadata.Version)
+		}
+		if u.state.ManifestInstalled && !installed {
+			return fmt.Errorf("la versión %s no tiene manifest firmado y ya se instaló una release con manifest - posible downgrade", metadata.Version)
+		}
+		return nil
+	}
+
+	manifestJSON, err := base64.StdEncoding.DecodeString(metadata.Manifest)
+	if err != nil {
+		return fmt.Errorf("manifest en base64 inválido")
+	}
+	signature, err := base64.StdEncoding.DecodeString(metadata.ManifestSignature)
+	if err != nil {
+		return fmt.Errorf("firma del manifest en base64 inválida")
+	}
+	err = keyfile.VerifyWithKeys(u.keys, metadata.KeyID, func(publicKey ed25519.PublicKey) bool {
+		return ed25519.Verify(publicKey, manifestJSON, signature)
+	})
+	if err != nil {
+		return fmt.Errorf("firma del manifest inválida - posible ataque: %w", err)
+	}
+
+	// Con una sola clave robada no alcanza para instalar nada
+	if u.config.SignatureThreshold > 1 {
+		signatures := []*keyfile.CoSignature{{KeyID: metadata.KeyID, Signature: metadata.ManifestSignature}}
+		signatures = append(signatures, metadata.Signatures...)
+		signers := keyfile.ValidSigners(u.keys, u.config.ThresholdKeys, manifestJSON, signatures)
+		if len(signers) < u.config.SignatureThreshold {
+			return fmt.Errorf("la versión %s tiene %d de %d firmas requeridas", metadata.Version, len(signers), u.config.SignatureThreshold)
+		}
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return fmt.Errorf("manifest ilegible: %w", err)
+	}
+	if manifest.Version != metadata.Version || manifest.Platform != metadata.Platform ||
+		manifest.Checksum != metadata.Checksum || manifest.BuildTime != metadata.BuildTime {
+		return fmt.Errorf("la metadata de Nexo no coincide con el manifest firmado - posible ataque")
+	}
+	expires, err := time.Parse(time.RFC3339, manifest.Expires)
+	if err != nil {
+		return fmt.Errorf("fecha de vencimiento del manifest inválida")
+	}
+	if !installed && time.Now().After(expires) {
+		return fmt.Errorf("el manifest de %s venció el %s", manifest.Version, manifest.Expires)
+	}
+
+	metadata.size = manifest.Size
+	return nil
+}
+
+// loadRotations aplica las rotaciones de claves aprendidas en chequeos
+// anteriores. Se verificaron al recibirlas, y la clave que firmó una
+// rotación vieja puede estar retirada.
+func (u *Updater) loadRotations() error {
+	data, err := os.ReadFile(u.keysPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var rotations []*keyfile.SignedRotation
+	if err := json.Unmarshal(data, &rotations); err != nil {
+		return fmt.Errorf("%s: %w", u.keysPath, err)
+	}
+	for _, signed := range rotations {
+		rotation, err := keyfile.DecodeRotation(signed)
+		if err != nil {
+			return fmt.Errorf("rotación %d: %w", signed.Sequence, err)
+		}
+		keys, err := keyfile.ApplyRotation(u.keys, rotation)
+		if err != nil {
+			return fmt.Errorf("rotación %d: %w", signed.Sequence, err)
+		}
+		u.keys = keys
+		u.rotations = append(u.rotations, signed)
+	}
+	return nil
+}
+
+// refreshKeys pide a Nexo las rotaciones de claves posteriores a la última
+// aplicada y aplica en orden las que firman claves vigentes, con el mismo
+// -signature-threshold que las releases. Así el Mac aprende la clave nueva
+// de una firma de la vieja antes de ver releases firmadas con ella. Nexo no
+// puede inventar rotaciones: sin firmas válidas se ignoran.
+func (u *Updater) refreshKeys() error {
+	var since int64
+	if len(u.rotations) > 0 {
+		since = u.rotations[len(u.rotations)-1].Sequence
+	}
+
+	resp, err := u.client(30 * time.Second).Get(fmt.Sprintf("%s/keys?since=%d", u.config.VpsHost, since))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		// Nexo anterior a las rotaciones de claves
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error HTTP %d", resp.StatusCode)
+	}
+
+	var rotations []*keyfile.SignedRotation
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&rotations); err != nil {
+		return fmt.Errorf("respuesta ilegible: %w", err)
+	}
+	sort.Slice(rotations, func(i, j int) bool {
+		return rotations[i].Sequence < rotations[j].Sequence
+	})
+
+	var rejected []string
+	for _, signed := range rotations {
+		if signed.Sequence <= since {
+			continue
+		}
+		// Una rotación que no verifica no se aplica, pero las siguientes
+		// pueden estar firmadas por una clave que sí conocemos (por ejemplo
+		// si este updater se instaló ya con la clave nueva)
+		rotation, err := keyfile.VerifyRotation(u.keys, u.config.ThresholdKeys, u.config.SignatureThreshold, signed)
+		if err == nil {
+			var keys []*keyfile.Key
+			keys, err = keyfile.ApplyRotation(u.keys, rotation)
+			if err == nil {
+				u.keys = keys
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("rotación %d rechazada: %v", signed.Sequence, err))
+			continue
+		}
+
+		u.rotations = append(u.rotations, signed)
+		since = rotation.Sequence
+		if err := u.saveRotations(); err != nil {
+			fmt.Printf("Advertencia: no se pudieron guardar las claves aprendidas: %v\n", err)
+		}
+
+		for _, entry := range rotation.Add {
+			key, _ := keyfile.ParseKeyEntry(entry)
+			fmt.Printf("Nueva clave de deploy %s (rotación %d, firmada por %s)\n", key.ID, rotation.Sequence, signed.KeyID)
+		}
+		for _, id := range rotation.Revoke {
+			fmt.Printf("Clave de deploy %s retirada (rotación %d)\n", id, rotation.Sequence)
+		}
+	}
+
+	if len(rejected) > 0 {
+		return errors.New(strings.Join(rejected, "; "))
+	}
+	return nil
+}
+
+func (u *Updater) saveRotations() error {
+	data, _ := json.MarshalIndent(u.rotations, "", "  ")
+	tmp := u.keysPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.keysPath)
+}
+
+func (u *Updater) checkUpdate() (bool, *Metadata, error) {
+	query := url.Values{}
+	query.Set("platform", u.config.Platform)
+	query.Set("channel", u.config.Channel)
+	query.Set("client_id", u.clientID)
+	resp, err := u.client(0).Get(u.config.VpsHost + "/latest?" + query.Encode())
+	if err != nil {
+		return false, nil, fmt.Errorf("error consultando VPS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil, nil
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Dispositivo pendiente de aprobación, revocado o sin credenciales
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, nil, fmt.Errorf("Nexo rechazó el acceso (HTTP 401): %s", strings.TrimSpace(string(msg)))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, nil, fmt.Errorf("error HTTP %d", resp.StatusCode)
+	}
+
+	var metadata Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return false, nil, fmt.Errorf("error decodificando metadata: %w", err)
+	}
+
+	if u.timestampKey != nil {
+		if err := u.verifyTimestamp(&metadata); err != nil {
+			fmt.Printf("ALERTA: timestamp de Nexo inválido: %v\n", err)
+			if age := u.staleness(); age > u.config.MaxStaleness && u.config.StaleAction == "refuse" {
+				return false, nil, fmt.Errorf("%w: sin metadata fresca de Nexo desde hace %s", errRejected, age.Round(time.Minute))
+			}
+		}
+	}
+
+	// Si Nexo ofrece el binario que ya está instalado, que su manifest haya
+	// vencido no es motivo para rechazarlo: el vencimiento solo frena
+	// instalaciones nuevas.
+	installed := false
+	if u.currentVer == "" {
+		checksum, err := fileChecksum(u.config.GigabotPath)
+		installed = err == nil && checksum == metadata.Checksum
+	} else if metadata.Version == u.currentVer {
+		installed = metadata.Checksum == u.state.Checksum || metadata.Checksum == u.state.PreviousChecksum
+	}
+
+	if err := u.verifyManifest(&metadata, installed); err != nil {
+		u.report(&metadata, "rejected", err)
+		return false, nil, fmt.Errorf("%w: %v", errRejected, err)
+	}
+
+	if metadata.Platform != u.config.Platform {
+		return false, nil, fmt.Errorf("el VPS ofreció un binario para %s (esperado %s)", metadata.Platform, u.config.Platform)
+	}
+
+	// Nunca se instala una versión más vieja que la actual: Nexo podría
+	// estar sirviendo una build vieja firmada para dejar al Mac con un bug
+	// conocido. Las versiones son timestamps, el orden lexicográfico sirve.
+	if u.currentVer != "" && metadata.Version < u.currentVer {
+		err := fmt.Errorf("el VPS ofreció %s, más vieja que la instalada (%s)", metadata.Version, u.currentVer)
+		u.report(&metadata, "rejected", err)
+		return false, nil, fmt.Errorf("%w: %v", errRejected, err)
+	}
+
+	if u.state.FailedChecksum != "" && metadata.Checksum == u.state.FailedChecksum {
+		fmt.Printf("La versión %s ya falló el período de prueba, se ignora\n", metadata.Version)
+		return false, &metadata, nil
+	}
+
+	if u.currentVer == "" {
+		// Sin estado local: si el binario en disco ya es esta versión no hace
+		// falta descargarlo ni reiniciar Gigabot, solo recordarlo.
+		if installed {
+			fmt.Printf("El binario en disco ya es la versión %s\n", metadata.Version)
+			u.recordInstall(&metadata)
+			return false, &metadata, nil
+		}
+		return true, &metadata, nil
+	}
+
+	if metadata.Version != u.currentVer {
+		return true, &metadata, nil
+	}
+
+	return false, &metadata, nil
+}
+
+func (u *Updater) downloadAndUpdate(metadata *Metadata) error {
+	tempPath := filepath.Join(u.config.TempDir, "gigabot-new")
+
+	// Primero se intenta con un patch sobre el binario actual; si no hay o
+	// falla se baja el binario completo. En los dos casos ya se compara el
+	// checksum con el de la metadata.
+	digest, err := u.downloadPatch(metadata, tempPath)
+	if err != nil {
+		if !errors.Is(err, errNoPatch) {
+			fmt.Printf("No se pudo usar el patch (%v), descargando binario completo...\n", err)
+		}
+		fmt.Printf("Descargando nueva versión a %s...\n", tempPath)
+		_, digest, err = u.download(metadata, tempPath)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println("Checksum verificado")
+
+	if metadata.size >= 0 {
+		info, err := os.Stat(tempPath)
+		if err != nil || info.Size() != metadata.size {
+			os.Remove(tempPath)
+			return fmt.Errorf("el tamaño del binario no coincide con el manifest")
+		}
+	}
+
+	if err := verifySignature(u.keys, metadata, tempPath, digest); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("firma Ed25519 inválida - posible ataque de inyección: %w", err)
+	}
+	fmt.Println("Firma Ed25519 verificada")
+
+	// Verificar si existe el binario actual
+	_, err = os.Stat(u.config.GigabotPath)
+	gigabotExists := err == nil
+
+	if gigabotExists {
+		// Flujo de actualización: detener, backup, reemplazar
+		fmt.Println("Deteniendo Gigabot actual...")
+		if err := u.stopGigabot(); err != nil {
+			fmt.Printf("Advertencia: error deteniendo Gigabot: %v\n", err)
+		}
+
+		time.Sleep(u.config.PostStopDelay)
+
+		backupPath := u.config.GigabotPath + ".backup"
+		if err := os.Rename(u.config.GigabotPath, backupPath); err != nil {
+			return fmt.Errorf("error haciendo backup: %w", err)
+		}
+
+		if err := os.Rename(tempPath, u.config.GigabotPath); err != nil {
+			os.Rename(backupPath, u.config.GigabotPath)
+			return fmt.Errorf("error reemplazando binario: %w", err)
+		}
+
+		clearQuarantine(u.config.GigabotPath)
+		fmt.Println("Binario reemplazado exitosamente")
+
+		u.prepareNewVersion()
+		if err := u.startGigabot(); err != nil {
+			u.endProbation()
+			os.Remove(u.config.GigabotPath)
+			os.Rename(backupPath, u.config.GigabotPath)
+			return fmt.Errorf("error iniciando nueva versión, rollback realizado: %w", err)
+		}
+
+		// El backup se conserva hasta que la versión nueva pasa el período de prueba
+		if err := u.probation(); err != nil {
+			fmt.Printf("La versión %s no pasó el período de prueba: %v\n", metadata.Version, err)
+			u.stopGigabot()
+
+			os.Remove(u.config.GigabotPath)
+			if rbErr := os.Rename(backupPath, u.config.GigabotPath); rbErr != nil {
+				u.markFailed(metadata)
+				u.report(metadata, "failed", err)
+				return fmt.Errorf("error restaurando backup: %v (período de prueba: %w)", rbErr, err)
+			}
+			if startErr := u.startGigabot(); startErr != nil {
+				fmt.Printf("Error iniciando la versión anterior: %v\n", startErr)
+			}
+
+			u.markFailed(metadata)
+			u.report(metadata, "rolled_back", err)
+			return fmt.Errorf("rollback a %s realizado: %w", u.currentVer, err)
+		}
+
+		// Pasada la prueba el backup queda como .previous, por si la versión
+		// nueva entra en crash loop dentro de RollbackWindow
+		if err := os.Rename(backupPath, u.previousPath()); err != nil {
+			fmt.Printf("Advertencia: no se pudo guardar la versión anterior: %v\n", err)
+			os.Remove(backupPath)
+		}
+	} else {
+		// Primera instalación: simplemente mover, poner +x y ejecutar
+		fmt.Println("Gigabot no existe, realizando primera instalación...")
+
+		if err := os.Rename(tempPath, u.config.GigabotPath); err != nil {
+			return fmt.Errorf("error guardando binario: %w", err)
+		}
+
+		// Asegurar permisos ejecutables
+		if err := os.Chmod(u.config.GigabotPath, 0755); err != nil {
+			fmt.Printf("Advertencia: error poniendo permisos ejecutables: %v\n", err)
+		}
+
+		clearQuarantine(u.config.GigabotPath)
+		fmt.Println("Binario instalado exitosamente")
+
+		u.prepareNewVersion()
+		if err := u.startGigabot(); err != nil {
+			u.endProbation()
+			return fmt.Errorf("error iniciando Gigabot: %w", err)
+		}
+
+		// Sin versión anterior no hay rollback posible, pero igual se avisa
+		if err := u.probation(); err != nil {
+			fmt.Printf("La versión %s no pasó el período de prueba: %v\n", metadata.Version, err)
+			u.markFailed(metadata)
+			u.report(metadata, "failed", err)
+			return fmt.Errorf("primera instalación no pasó el período de prueba: %w", err)
+		}
+	}
+
+	u.report(metadata, "installed", nil)
+	return nil
+}
+
+// reconcileState carga el estado guardado y lo compara con el SHA-256 del
+// binario en disco. Solo se confía en la versión guardada si el binario es
+// realmente el que se instaló; si no, la versión queda desconocida.
+func (u *Updater) reconcileState() error {
+	data, err := os.ReadFile(u.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, &u.state); err != nil {
+		return err
+	}
+
+	checksum, err := fileChecksum(u.config.GigabotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("El estado local menciona una versión pero el binario no existe")
+			return nil
+		}
+		return err
+	}
+
+	switch checksum {
+	case u.state.Checksum:
+		u.currentVer = u.state.Version
+	case u.state.PreviousChecksum:
+		// Alguien restauró a mano la versión anterior
+		fmt.Printf("El binario en disco es la versión anterior (%s)\n", u.state.PreviousVersion)
+		u.currentVer = u.state.PreviousVersion
+	default:
+		fmt.Println("El binario en disco no coincide con el estado local, versión desconocida")
+	}
+	return nil
+}
+
+// recordInstall actualiza y persiste el estado después de instalar (o
+// reconocer) una versión.
+func (u *Updater) recordInstall(metadata *Metadata) {
+	if metadata.Checksum != u.state.Checksum {
+		u.state.PreviousVersion = u.state.Version
+		u.state.PreviousChecksum = u.state.Checksum
+	}
+	u.state.Version = metadata.Version
+	u.state.Checksum = metadata.Checksum
+	u.state.InstalledAt = time.Now().Format(time.RFC3339)
+	if metadata.Manifest != "" {
+		u.state.ManifestInstalled = true
+	}
+	if metadata.Checksum == u.state.FailedChecksum {
+		u.state.FailedVersion = ""
+		u.state.FailedChecksum = ""
+	}
+	u.currentVer = metadata.Version
+
+	if err := u.saveState(); err != nil {
+		fmt.Printf("Advertencia: no se pudo guardar el estado local: %v\n", err)
+	}
+}
+
+func (u *Updater) previousPath() string {
+	return u.config.GigabotPath + ".previous"
+}
+
+// rollbackToPrevious vuelve a la versión anterior guardada en .previous
+// cuando la actual entra en crash loop poco después de instalarse. Se llama
+// con updateMu tomado y Gigabot detenido.
+func (u *Updater) rollbackToPrevious(cause error) error {
+	if u.state.PreviousVersion == "" {
+		return fmt.Errorf("no hay versión anterior registrada")
+	}
+	checksum, err := fileChecksum(u.previousPath())
+	if err != nil {
+		return fmt.Errorf("versión anterior no disponible: %w", err)
+	}
+	if checksum != u.state.PreviousChecksum {
+		return fmt.Errorf("la versión anterior en disco no coincide con el estado local")
+	}
+
+	failed := &Metadata{
+		Version:  u.state.Version,
+		Checksum: u.state.Checksum,
+		Platform: u.config.Platform,
+	}
+
+	os.Remove(u.config.GigabotPath)
+	if err := os.Rename(u.previousPath(), u.config.GigabotPath); err != nil {
+		return fmt.Errorf("error restaurando versión anterior: %w", err)
+	}
+
+	u.state.Version = u.state.PreviousVersion
+	u.state.Checksum = u.state.PreviousChecksum
+	u.state.PreviousVersion = ""
+	u.state.PreviousChecksum = ""
+	u.state.InstalledAt = time.Now().Format(time.RFC3339)
+	u.currentVer = u.state.Version
+	u.markFailed(failed)
+
+	fmt.Printf("Rollback a %s realizado\n", u.currentVer)
+	u.report(failed, "rolled_back", cause)
+	return nil
+}
+
+// markFailed recuerda una versión que no pasó el período de prueba para no
+// volver a instalarla en cada chequeo.
+func (u *Updater) markFailed(metadata *Metadata) {
+	u.state.FailedVersion = metadata.Version
+	u.state.FailedChecksum = metadata.Checksum
+	if err := u.saveState(); err != nil {
+		fmt.Printf("Advertencia: no se pudo guardar el estado local: %v\n", err)
+	}
+}
+
+func (u *Updater) saveState() error {
+	data, _ := json.MarshalIndent(u.state, "", "  ")
+	tmp := u.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.statePath)
+}
+
+// fileChecksum calcula el SHA-256 de un archivo sin cargarlo entero en memoria.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// loadClientID lee el identificador persistente de este updater, o genera uno
+// nuevo la primera vez. Nexo lo usa para decidir si entra en un rollout.
+func loadClientID(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// clearQuarantine quita los atributos extendidos que en macOS bloquean la
+// ejecución de binarios descargados. En otros sistemas no hace nada.
+func clearQuarantine(path string) {
+	if runtime.GOOS != "darwin" {
+		return
+	}
+	exec.Command("xattr", "-c", path).Run()
+}
+
+func (u *Updater) startGigabot() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.startLocked()
+}
+
+// childEnv arma el entorno de Gigabot: el del updater, después el env file,
+// las variables configuradas y por último los secretos. Los archivos se leen
+// en cada inicio para que un reinicio tome los cambios.
+func (u *Updater) childEnv() ([]string, error) {
+	env := os.Environ()
+
+	if u.config.EnvFile != "" {
+		vars, err := readEnvFile(u.config.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("error leyendo env file: %w", err)
+		}
+		env = append(env, vars...)
+	}
+
+	env = append(env, u.config.Env...)
+
+	if u.config.SecretsFile != "" {
+		info, err := os.Stat(u.config.SecretsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error leyendo secretos: %w", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("%s es accesible por otros usuarios (%s), usar chmod 600", u.config.SecretsFile, info.Mode().Perm())
+		}
+		vars, err := readEnvFile(u.config.SecretsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error leyendo secretos: %w", err)
+		}
+		env = append(env, vars...)
+	}
+
+	return env, nil
+}
+
+// readEnvFile lee un archivo con líneas KEY=VALUE. Ignora líneas vacías y
+// comentarios (#), acepta el prefijo "export " y comillas alrededor del valor.
+func readEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			// No se muestra la línea: puede tener un secreto
+			return nil, fmt.Errorf("%s:%d: se esperaba KEY=VALUE", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, key+"="+value)
+	}
+	return vars, nil
+}
+
+// startLocked inicia Gigabot si no está corriendo. Se llama con u.mu tomado.
+func (u *Updater) startLocked() error {
+	if u.gigabotCmd != nil {
+		return nil
+	}
+
+	fmt.Printf("Iniciando Gigabot: %s\n", u.config.GigabotPath)
+
+	if u.config.ReadyFile != "" {
+		// Se borra antes de arrancar para no confundirlo con el de la versión anterior
+		os.Remove(u.config.ReadyFile)
+	}
+
+	env, err := u.childEnv()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(u.config.GigabotPath, u.config.Args...)
+	cmd.Env = env
+	cmd.Dir = u.config.WorkingDir
+	// Grupo de procesos propio para poder detener también los procesos
+	// que lance Gigabot
+	setProcessGroup(cmd)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	var marker *markerWriter
+	if u.config.ReadyMarker != "" {
+		marker = newMarkerWriter(u.config.ReadyMarker)
+		cmd.Stdout = io.MultiWriter(os.Stdout, marker)
+		cmd.Stderr = io.MultiWriter(os.Stderr, marker)
+	}
+
+	if u.config.User != "" {
+		if err := setUser(cmd, u.config.User); err != nil {
+			return err
+		}
+	}
+
+	if err := startWithUmask(cmd, u.config.Umask); err != nil {
+		return fmt.Errorf("error iniciando proceso: %w", err)
+	}
+
+	done := make(chan struct{})
+	u.gigabotCmd = cmd
+	u.gigabotDone = done
+	u.readyMarker = marker
+	u.stopping = false
+	fmt.Printf("Gigabot iniciado con PID %d\n", cmd.Process.Pid)
+
+	go u.supervise(cmd, done)
+
+	return nil
+}
+
+// ensureRunning inicia Gigabot si no está corriendo, salvo que el supervisor
+// ya tenga un reinicio programado o esté esperando por un crash loop.
+func (u *Updater) ensureRunning() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.gigabotCmd != nil || u.restartPending || u.crashLoop {
+		return
+	}
+	if err := u.startLocked(); err != nil {
+		fmt.Printf("Error iniciando Gigabot: %v\n", err)
+	}
+}
+
+// supervise espera a que termine el proceso y, si no fue un stop a propósito,
+// programa el reinicio. Es el único lugar que llama a cmd.Wait.
+func (u *Updater) supervise(cmd *exec.Cmd, done chan struct{}) {
+	err := cmd.Wait()
+	if err != nil {
+		fmt.Printf("Gigabot terminó con error: %v\n", err)
+	} else {
+		fmt.Println("Gigabot terminó normalmente")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	close(done)
+	if u.gigabotCmd != cmd {
+		return
+	}
+	u.gigabotCmd = nil
+	if u.stopping || u.inProbation {
+		return
+	}
+
+	now := time.Now()
+	recent := u.crashes[:0]
+	for _, t := range u.crashes {
+		if now.Sub(t) < u.config.CrashWindow {
+			recent = append(recent, t)
+		}
+	}
+	u.crashes = append(recent, now)
+	count := len(u.crashes)
+
+	if u.config.MaxRestarts > 0 && count > u.config.MaxRestarts {
+		u.crashLoop = true
+		fmt.Printf("CRASH LOOP: %d caídas en %s\n", count, u.config.CrashWindow)
+
+		installedAt, _ := time.Parse(time.RFC3339, u.state.InstalledAt)
+		if u.state.PreviousVersion != "" && now.Sub(installedAt) < u.config.RollbackWindow {
+			go u.crashLoopRollback(u.state.Checksum, fmt.Errorf("crash loop: %d caídas en %s (%v)", count, u.config.CrashWindow, err))
+			return
+		}
+
+		// Sin rollback posible se espera a que la caída más vieja salga de la ventana
+		wait := u.crashes[0].Add(u.config.CrashWindow).Sub(now)
+		fmt.Printf("Sin reinicios automáticos durante %s\n", wait.Round(time.Second))
+		u.scheduleRestart(wait)
+		return
+	}
+
+	delay := time.Duration(0)
+	if count > 1 {
+		delay = u.config.RestartDelay << uint(count-2)
+		if delay > u.config.MaxRestartDelay || delay <= 0 {
+			delay = u.config.MaxRestartDelay
+		}
+	}
+	fmt.Printf("Reiniciando Gigabot en %s (caída %d en %s)\n", delay, count, u.config.CrashWindow)
+	u.scheduleRestart(delay)
+}
+
+// scheduleRestart programa un reinicio. Se llama con u.mu tomado.
+func (u *Updater) scheduleRestart(delay time.Duration) {
+	u.restartPending = true
+	time.AfterFunc(delay, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		u.restartPending = false
+		u.crashLoop = false
+		if u.stopping || u.gigabotCmd != nil {
+			return
+		}
+		if err := u.startLocked(); err != nil {
+			fmt.Printf("Error reiniciando Gigabot: %v\n", err)
+		}
+	})
+}
+
+// crashLoopRollback vuelve a la versión anterior si la versión que entró en
+// crash loop sigue siendo la instalada (checksum), y reinicia Gigabot.
+func (u *Updater) crashLoopRollback(checksum string, cause error) {
+	u.updateMu.Lock()
+	defer u.updateMu.Unlock()
+
+	if u.state.Checksum == checksum {
+		if err := u.rollbackToPrevious(cause); err != nil {
+			fmt.Printf("Error en rollback por crash loop: %v\n", err)
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.crashes = nil
+	u.crashLoop = false
+	if err := u.startLocked(); err != nil {
+		fmt.Printf("Error iniciando Gigabot: %v\n", err)
+	}
 }
 
-type Metadata struct {
-	Version   string `json:"version"`
-	BuildTime string `json:"build_time"`
-	Checksum  string `json:"checksum"`
-	Platform  string `json:"platform"`
-	Signature string `json:"signature"`
+// prepareNewVersion se llama antes de iniciar un binario recién instalado:
+// las caídas de la versión anterior no cuentan, y hasta que termine el
+// período de prueba las caídas las maneja probation en vez del supervisor.
+func (u *Updater) prepareNewVersion() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.crashes = nil
+	u.crashLoop = false
+	u.inProbation = u.config.ProbationWindow > 0
 }
 
-type Updater struct {
-	config     Config
-	publicKey  ed25519.PublicKey
-	currentVer string
-	gigabotCmd *exec.Cmd
+func (u *Updater) endProbation() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.inProbation = false
 }
 
-func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Uso: updater-mac <vps-host> <public-key-file> <gigabot-path>")
-		fmt.Println("Ejemplo: updater-mac https://tu-vps.com:8443 deploy-public.key ./gigabot")
-		os.Exit(1)
-	}
+func (u *Updater) stopGigabot() error {
+	u.mu.Lock()
+	cmd, done := u.gigabotCmd, u.gigabotDone
+	u.stopping = true
+	u.mu.Unlock()
 
-	publicKeyPEM, err := os.ReadFile(os.Args[2])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error leyendo clave pública: %v\n", err)
-		os.Exit(1)
+	if cmd == nil || cmd.Process == nil {
+		return nil
 	}
 
-	publicKey, err := parsePublicKey(publicKeyPEM)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parseando clave pública: %v\n", err)
-		os.Exit(1)
+	u.preStop(cmd.Process.Pid, done)
+
+	pid := cmd.Process.Pid
+	fmt.Printf("Enviando %s al grupo de PID %d...\n", u.config.StopSignal, pid)
+
+	signalGroup(cmd.Process, u.config.StopSignal)
+
+	// supervise es la única que llama a Wait
+	select {
+	case <-done:
+		fmt.Println("Gigabot detenido")
+	case <-time.After(u.config.StopTimeout):
+		fmt.Println("Timeout esperando, forzando kill...")
+		killGroup(cmd.Process)
+		cmd.Process.Kill()
+		<-done
 	}
 
-	updater := &Updater{
-		config: Config{
-			VpsHost:       os.Args[1],
-			CheckInterval: 5 * time.Minute,
-			GigabotPath:   os.Args[3],
-			TempDir:       os.TempDir(),
-		},
-		publicKey:  publicKey,
-		currentVer: "",
+	// Procesos hijos que ignoraron la señal o siguen vivos sin su padre
+	if err := killGroup(cmd.Process); err == nil {
+		fmt.Println("Procesos restantes del grupo terminados")
 	}
 
-	fmt.Println("Updater Mac iniciado")
-	fmt.Printf("VPS: %s\n", updater.config.VpsHost)
-	fmt.Printf("Gigabot: %s\n", updater.config.GigabotPath)
-	fmt.Printf("Intervalo de chequeo: %s\n", updater.config.CheckInterval)
+	return nil
+}
 
-	if err := updater.run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error fatal: %v\n", err)
-		os.Exit(1)
+// preStop ejecuta el hook configurado para que Gigabot termine los trabajos
+// en curso antes de recibir la señal. Un error en el hook no impide detenerlo.
+func (u *Updater) preStop(pid int, done chan struct{}) {
+	if u.config.PreStopURL == "" && u.config.PreStopCommand == "" {
+		return
 	}
-}
 
-func (u *Updater) run() error {
-	for {
-		needsUpdate, metadata, err := u.checkUpdate()
+	fmt.Println("Ejecutando pre-stop...")
+
+	if u.config.PreStopURL != "" {
+		client := &http.Client{Timeout: u.config.PreStopTimeout}
+		resp, err := client.Post(u.config.PreStopURL, "text/plain", nil)
 		if err != nil {
-			fmt.Printf("Error chequeando actualización: %v\n", err)
-			fmt.Println("Reintentando en 1 minuto...")
-			time.Sleep(1 * time.Minute)
-			continue
+			fmt.Printf("Advertencia: pre-stop %s falló: %v\n", u.config.PreStopURL, err)
+		} else {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				fmt.Printf("Advertencia: pre-stop %s respondió %d\n", u.config.PreStopURL, resp.StatusCode)
+			}
 		}
+	}
 
-		if !needsUpdate {
-			fmt.Printf("Versión actual (%s) es la última. Esperando...\n", u.currentVer)
-
-			if u.gigabotCmd == nil || (u.gigabotCmd.ProcessState != nil && u.gigabotCmd.ProcessState.Exited()) {
-				if err := u.startGigabot(); err != nil {
-					fmt.Printf("Error iniciando Gigabot: %v\n", err)
+	if u.config.PreStopCommand != "" {
+		hook := exec.Command("sh", "-c", u.config.PreStopCommand)
+		hook.Env = append(os.Environ(), fmt.Sprintf("GIGABOT_PID=%d", pid))
+		hook.Stdout = os.Stdout
+		hook.Stderr = os.Stderr
+		if err := hook.Start(); err != nil {
+			fmt.Printf("Advertencia: pre-stop no se pudo ejecutar: %v\n", err)
+		} else {
+			finished := make(chan error, 1)
+			go func() { finished <- hook.Wait() }()
+			select {
+			case err := <-finished:
+				if err != nil {
+					fmt.Printf("Advertencia: pre-stop terminó con error: %v\n", err)
 				}
+			case <-time.After(u.config.PreStopTimeout):
+				fmt.Println("Advertencia: timeout en pre-stop")
+				hook.Process.Kill()
 			}
-
-			time.Sleep(u.config.CheckInterval)
-			continue
 		}
+	}
+
+	select {
+	case <-done:
+		fmt.Println("Gigabot terminó durante el pre-stop")
+	default:
+	}
+}
 
-		fmt.Printf("Nueva versión disponible: %s (actual: %s)\n", metadata.Version, u.currentVer)
+var errDownload = errors.New("descarga incompleta")
+
+// download baja el binario a tempPath y devuelve su SHA-256 y SHA-512. La
+// descarga se guarda en un .part con el checksum en el nombre: si se corta,
+// se reintenta retomando desde donde quedó, y lo mismo en el próximo
+// chequeo o después de reiniciar el updater. Si Nexo tiene la release
+// comprimida se baja con gzip y se descomprime al terminar.
+func (u *Updater) download(metadata *Metadata, tempPath string) ([]byte, []byte, error) {
+	base := filepath.Join(u.config.TempDir, "gigabot-"+metadata.Checksum)
+	removeStaleParts(u.config.TempDir, base)
+
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		if attempt > 1 {
+			fmt.Printf("Descarga interrumpida (%v), reintentando...\n", err)
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
 
-		if err := u.downloadAndUpdate(metadata); err != nil {
-			fmt.Printf("Error actualizando: %v\n", err)
-			time.Sleep(u.config.CheckInterval)
+		var partPath, encoding string
+		partPath, encoding, err = u.downloadPart(metadata, base)
+		if err != nil {
 			continue
 		}
 
-		u.currentVer = metadata.Version
-		fmt.Printf("Actualización a %s completada exitosamente\n", metadata.Version)
-
-		time.Sleep(u.config.CheckInterval)
+		checksum, digest, err := decodePart(partPath, encoding, tempPath)
+		os.Remove(partPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if checksumHex := fmt.Sprintf("%x", checksum); checksumHex != metadata.Checksum {
+			os.Remove(tempPath)
+			return nil, nil, fmt.Errorf("checksum inválido: esperado %s, recibido %s", metadata.Checksum, checksumHex)
+		}
+		return checksum, digest, nil
 	}
+	return nil, nil, fmt.Errorf("%w: %v", errDownload, err)
 }
 
-func (u *Updater) checkUpdate() (bool, *Metadata, error) {
-	resp, err := http.Get(u.config.VpsHost + "/latest")
+// downloadPart continúa la descarga en base.part (binario plano) o
+// base.gz.part (comprimido). Pide solo lo que falta con Range e If-Range
+// (ETag = checksum, con -gzip para la versión comprimida); si Nexo responde
+// 200 en vez de 206 el archivo parcial se descarta y se baja completo.
+// Devuelve el archivo completo y su Content-Encoding.
+func (u *Updater) downloadPart(metadata *Metadata, base string) (string, string, error) {
+	partPath, encoding, etag := base+".part", "", metadata.Checksum
+	if _, err := os.Stat(base + ".gz.part"); err == nil {
+		partPath, encoding, etag = base+".gz.part", "gzip", metadata.Checksum+"-gzip"
+	}
+
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	query := url.Values{}
+	query.Set("version", metadata.Version)
+	query.Set("platform", metadata.Platform)
+	query.Set("channel", u.config.Channel)
+	query.Set("client_id", u.clientID)
+	req, err := http.NewRequest(http.MethodGet, u.config.VpsHost+"/download?"+query.Encode(), nil)
 	if err != nil {
-		return false, nil, fmt.Errorf("error consultando VPS: %w", err)
+		return "", "", err
+	}
+	// Se pide gzip explícitamente: así el cliente HTTP no lo descomprime
+	// solo y la descarga comprimida también se puede retomar
+	req.Header.Set("Accept-Encoding", "gzip")
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", `"`+etag+`"`)
+	}
+
+	resp, err := u.client(0).Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("error descargando: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return false, nil, nil
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return "", "", fmt.Errorf("Content-Range inesperado: %q", resp.Header.Get("Content-Range"))
+		}
+		fmt.Printf("Retomando descarga desde %d bytes...\n", offset)
+	case resp.StatusCode == http.StatusOK:
+		os.Remove(base + ".part")
+		os.Remove(base + ".gz.part")
+		offset = 0
+		switch resp.Header.Get("Content-Encoding") {
+		case "":
+			partPath, encoding = base+".part", ""
+		case "gzip":
+			partPath, encoding = base+".gz.part", "gzip"
+		default:
+			return "", "", fmt.Errorf("Content-Encoding no soportado: %s", resp.Header.Get("Content-Encoding"))
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// El parcial no corresponde a este binario: se empieza de nuevo
+		os.Remove(partPath)
+		return "", "", fmt.Errorf("rango inválido, descarga reiniciada")
+	default:
+		return "", "", fmt.Errorf("error HTTP %d descargando", resp.StatusCode)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return false, nil, fmt.Errorf("error HTTP %d", resp.StatusCode)
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", "", fmt.Errorf("error guardando archivo temporal: %w", err)
 	}
+	defer file.Close()
 
-	var metadata Metadata
-	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
-		return false, nil, fmt.Errorf("error decodificando metadata: %w", err)
+	if err := file.Truncate(offset); err != nil {
+		return "", "", err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		return "", "", fmt.Errorf("error leyendo datos: %w", err)
 	}
+	if err := file.Close(); err != nil {
+		return "", "", fmt.Errorf("error guardando archivo temporal: %w", err)
+	}
+	return partPath, encoding, nil
+}
 
-	if u.currentVer == "" {
-		return true, &metadata, nil
+// decodePart copia la descarga completa a tempPath, descomprimiéndola si
+// hace falta, y devuelve SHA-256 y SHA-512 del binario sin comprimir. La
+// memoria no depende del tamaño del binario.
+func decodePart(partPath, encoding, tempPath string) ([]byte, []byte, error) {
+	part, err := os.Open(partPath)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer part.Close()
 
-	if metadata.Version != u.currentVer {
-		return true, &metadata, nil
+	var src io.Reader = part
+	if encoding == "gzip" {
+		zr, err := gzip.NewReader(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error descomprimiendo: %w", err)
+		}
+		src = zr
 	}
 
-	return false, &metadata, nil
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error guardando archivo temporal: %w", err)
+	}
+	defer out.Close()
+
+	sum256, sum512 := sha256.New(), sha512.New()
+	if _, err := io.Copy(io.MultiWriter(out, sum256, sum512), src); err != nil {
+		os.Remove(tempPath)
+		return nil, nil, fmt.Errorf("error descomprimiendo: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tempPath)
+		return nil, nil, fmt.Errorf("error guardando archivo temporal: %w", err)
+	}
+	return sum256.Sum(nil), sum512.Sum(nil), nil
 }
 
-func (u *Updater) downloadAndUpdate(metadata *Metadata) error {
-	tempPath := filepath.Join(u.config.TempDir, "gigabot-new")
+var errNoPatch = errors.New("no hay patch para el binario actual")
+
+// downloadPatch baja el patch desde el binario instalado y lo aplica en
+// tempPath. Devuelve el SHA-512 del resultado, que ya se comparó contra el
+// checksum firmado de la release.
+func (u *Updater) downloadPatch(metadata *Metadata, tempPath string) ([]byte, error) {
+	if len(metadata.Patches) == 0 {
+		return nil, errNoPatch
+	}
+	current, err := fileChecksum(u.config.GigabotPath)
+	if err != nil {
+		return nil, errNoPatch
+	}
+	var patch *Patch
+	for _, p := range metadata.Patches {
+		if p.FromChecksum == current {
+			patch = p
+			break
+		}
+	}
+	if patch == nil {
+		return nil, errNoPatch
+	}
 
-	fmt.Printf("Descargando nueva versión a %s...\n", tempPath)
+	fmt.Printf("Descargando patch desde %s (%d bytes)...\n", patch.FromVersion, patch.Size)
 
-	resp, err := http.Get(u.config.VpsHost + "/download")
+	query := url.Values{}
+	query.Set("version", metadata.Version)
+	query.Set("platform", metadata.Platform)
+	query.Set("from", current)
+	query.Set("channel", u.config.Channel)
+	query.Set("client_id", u.clientID)
+	resp, err := u.client(0).Get(u.config.VpsHost + "/patch?" + query.Encode())
 	if err != nil {
-		return fmt.Errorf("error descargando: %w", err)
+		return nil, fmt.Errorf("error descargando patch: %w", err)
 	}
 	defer resp.Body.Close()
-
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error HTTP %d descargando", resp.StatusCode)
+		return nil, fmt.Errorf("error HTTP %d descargando patch", resp.StatusCode)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	// El patch se guarda entero antes de aplicarlo para verificar su checksum
+	patchPath := tempPath + ".delta"
+	defer os.Remove(patchPath)
+	patchFile, err := os.OpenFile(patchPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 	if err != nil {
-		return fmt.Errorf("error leyendo datos: %w", err)
+		return nil, err
 	}
+	defer patchFile.Close()
 
-	checksum := sha256.Sum256(data)
-	checksumHex := fmt.Sprintf("%x", checksum)
-	if checksumHex != metadata.Checksum {
-		return fmt.Errorf("checksum inválido: esperado %s, recibido %s", metadata.Checksum, checksumHex)
+	patchHash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(patchFile, patchHash), io.LimitReader(resp.Body, patch.Size+1)); err != nil {
+		return nil, fmt.Errorf("error descargando patch: %w", err)
+	}
+	if fmt.Sprintf("%x", patchHash.Sum(nil)) != patch.Checksum {
+		return nil, fmt.Errorf("checksum del patch inválido")
+	}
+	if _, err := patchFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
-	fmt.Println("Checksum verificado")
 
-	sigBytes, err := base64.StdEncoding.DecodeString(metadata.Signature)
+	source, err := os.Open(u.config.GigabotPath)
 	if err != nil {
-		return fmt.Errorf("error decodificando firma: %w", err)
+		return nil, err
+	}
+	defer source.Close()
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return nil, err
 	}
 
-	if !ed25519.Verify(u.publicKey, data, sigBytes) {
-		return fmt.Errorf("firma Ed25519 inválida - posible ataque de inyección")
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error guardando archivo temporal: %w", err)
 	}
-	fmt.Println("Firma Ed25519 verificada")
+	defer out.Close()
 
-	if err := os.WriteFile(tempPath, data, 0755); err != nil {
-		return fmt.Errorf("error guardando archivo temporal: %w", err)
+	sum256, sum512 := sha256.New(), sha512.New()
+	if err := delta.Apply(patchFile, source, sourceInfo.Size(), current, io.MultiWriter(out, sum256, sum512)); err != nil {
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("error aplicando patch: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("error guardando archivo temporal: %w", err)
 	}
 
-	// Verificar si existe el binario actual
-	_, err = os.Stat(u.config.GigabotPath)
-	gigabotExists := err == nil
+	if checksumHex := fmt.Sprintf("%x", sum256.Sum(nil)); checksumHex != metadata.Checksum {
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("el binario reconstruido no coincide: esperado %s, obtenido %s", metadata.Checksum, checksumHex)
+	}
 
-	if gigabotExists {
-		// Flujo de actualización: detener, backup, reemplazar
-		fmt.Println("Deteniendo Gigabot actual...")
-		if err := u.stopGigabot(); err != nil {
-			fmt.Printf("Advertencia: error deteniendo Gigabot: %v\n", err)
+	fmt.Println("Patch aplicado")
+	return sum512.Sum(nil), nil
+}
+
+// removeStaleParts borra descargas parciales de otras versiones.
+func removeStaleParts(dir, keep string) {
+	parts, _ := filepath.Glob(filepath.Join(dir, "gigabot-*.part"))
+	for _, part := range parts {
+		if part != keep+".part" && part != keep+".gz.part" {
+			os.Remove(part)
 		}
+	}
+}
 
-		time.Sleep(2 * time.Second)
+// verifySignature verifica la firma del binario descargado. Ed25519ph usa
+// el SHA-512 calculado durante la descarga; las releases firmadas antes
+// (Ed25519 puro) necesitan el binario completo en memoria, hasta
+// maxLegacySignedSize.
+func verifySignature(keys []*keyfile.Key, metadata *Metadata, path string, digest []byte) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(metadata.Signature)
+	if err != nil {
+		return fmt.Errorf("error decodificando firma: %w", err)
+	}
 
-		backupPath := u.config.GigabotPath + ".backup"
-		if err := os.Rename(u.config.GigabotPath, backupPath); err != nil {
-			return fmt.Errorf("error haciendo backup: %w", err)
+	switch metadata.SignatureAlg {
+	case "ed25519ph":
+		return keyfile.VerifyWithKeys(keys, metadata.KeyID, func(publicKey ed25519.PublicKey) bool {
+			return ed25519.VerifyWithOptions(publicKey, digest, sigBytes, &ed25519.Options{Hash: crypto.SHA512}) == nil
+		})
+	case "", "ed25519":
+		data, err := readLegacySigned(path)
+		if err != nil {
+			return err
 		}
+		return keyfile.VerifyWithKeys(keys, metadata.KeyID, func(publicKey ed25519.PublicKey) bool {
+			return ed25519.Verify(publicKey, data, sigBytes)
+		})
+	default:
+		return fmt.Errorf("algoritmo de firma desconocido: %q", metadata.SignatureAlg)
+	}
+}
 
-		if err := os.Rename(tempPath, u.config.GigabotPath); err != nil {
-			os.Rename(backupPath, u.config.GigabotPath)
-			return fmt.Errorf("error reemplazando binario: %w", err)
-		}
+// maxLegacySignedSize es el tamaño máximo de un binario con firma Ed25519
+// pura (deployers anteriores), que hay que tener entero en memoria para
+// verificarlo. Los más grandes se vuelven a subir con un deployer actual.
+const maxLegacySignedSize = 256 << 20
 
-		exec.Command("xattr", "-c", u.config.GigabotPath).Run()
-		fmt.Println("Binario reemplazado exitosamente")
+func readLegacySigned(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		if err := u.startGigabot(); err != nil {
-			os.Remove(u.config.GigabotPath)
-			os.Rename(backupPath, u.config.GigabotPath)
-			return fmt.Errorf("error iniciando nueva versión, rollback realizado: %w", err)
-		}
+	data, err := io.ReadAll(io.LimitReader(f, maxLegacySignedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLegacySignedSize {
+		return nil, fmt.Errorf("binario con firma Ed25519 pura de más de %d MB: volver a subirlo con un deployer actual (Ed25519ph)", maxLegacySignedSize>>20)
+	}
+	return data, nil
+}
 
-		os.Remove(backupPath)
-	} else {
-		// Primera instalación: simplemente mover, poner +x y ejecutar
-		fmt.Println("Gigabot no existe, realizando primera instalación...")
+// probation vigila la versión recién iniciada durante ProbationWindow. Falla
+// si el proceso termina, y al final del período exige que respondan los
+// chequeos configurados (health URL, ready file y ready marker).
+func (u *Updater) probation() error {
+	if u.config.ProbationWindow <= 0 {
+		return nil
+	}
 
-		if err := os.Rename(tempPath, u.config.GigabotPath); err != nil {
-			return fmt.Errorf("error guardando binario: %w", err)
-		}
+	defer u.endProbation()
 
-		// Asegurar permisos ejecutables
-		if err := os.Chmod(u.config.GigabotPath, 0755); err != nil {
-			fmt.Printf("Advertencia: error poniendo permisos ejecutables: %v\n", err)
-		}
+	u.mu.Lock()
+	done, marker := u.gigabotDone, u.readyMarker
+	u.mu.Unlock()
 
-		exec.Command("xattr", "-c", u.config.GigabotPath).Run()
-		fmt.Println("Binario instalado exitosamente")
+	fmt.Printf("Período de prueba de %s...\n", u.config.ProbationWindow)
 
-		if err := u.startGigabot(); err != nil {
-			return fmt.Errorf("error iniciando Gigabot: %w", err)
+	pollEvery := u.config.ProbationWindow / 10
+	if pollEvery < time.Second {
+		pollEvery = time.Second
+	}
+	ticker := time.NewTicker(pollEvery)
+	defer ticker.Stop()
+	deadline := time.After(u.config.ProbationWindow)
+
+	var healthErr error
+	if u.config.HealthURL != "" {
+		healthErr = fmt.Errorf("health check sin respuesta todavía")
+	}
+
+	for {
+		select {
+		case <-done:
+			return fmt.Errorf("el proceso terminó durante el período de prueba")
+		case <-ticker.C:
+			if u.config.HealthURL != "" {
+				healthErr = checkHealth(u.config.HealthURL)
+			}
+		case <-deadline:
+			if u.config.HealthURL != "" {
+				healthErr = checkHealth(u.config.HealthURL)
+				if healthErr != nil {
+					return healthErr
+				}
+			}
+			if u.config.ReadyFile != "" {
+				if _, err := os.Stat(u.config.ReadyFile); err != nil {
+					return fmt.Errorf("ready file %s no apareció", u.config.ReadyFile)
+				}
+			}
+			if marker != nil && !marker.seen() {
+				return fmt.Errorf("no apareció el texto %q en la salida", u.config.ReadyMarker)
+			}
+			fmt.Println("Período de prueba superado")
+			return nil
 		}
 	}
+}
 
+func checkHealth(healthURL string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check: HTTP %d", resp.StatusCode)
+	}
 	return nil
 }
 
-func (u *Updater) startGigabot() error {
-	fmt.Printf("Iniciando Gigabot: %s\n", u.config.GigabotPath)
-
-	cmd := exec.Command(u.config.GigabotPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("error iniciando proceso: %w", err)
+// report avisa a Nexo cómo terminó una actualización para poder seguir el
+// rollout. Es best-effort: si falla solo se registra localmente.
+func (u *Updater) report(metadata *Metadata, status string, cause error) {
+	payload := map[string]string{
+		"client_id": u.clientID,
+		"version":   metadata.Version,
+		"platform":  metadata.Platform,
+		"channel":   u.config.Channel,
+		"status":    status,
+	}
+	if cause != nil {
+		payload["error"] = cause.Error()
 	}
+	body, _ := json.Marshal(payload)
 
-	u.gigabotCmd = cmd
-	fmt.Printf("Gigabot iniciado con PID %d\n", cmd.Process.Pid)
+	resp, err := u.client(10*time.Second).Post(u.config.VpsHost+"/report", "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Advertencia: no se pudo reportar a Nexo: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+}
 
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			fmt.Printf("Gigabot terminó con error: %v\n", err)
-		} else {
-			fmt.Println("Gigabot terminó normalmente")
-		}
-		u.gigabotCmd = nil
-	}()
+// markerWriter recibe la salida de Gigabot y detecta cuándo aparece el texto
+// de "listo", aunque llegue partido entre dos escrituras.
+type markerWriter struct {
+	marker []byte
+	mu     sync.Mutex
+	tail   []byte
+	found  bool
+}
 
-	return nil
+func newMarkerWriter(marker string) *markerWriter {
+	return &markerWriter{marker: []byte(marker)}
 }
 
-func (u *Updater) stopGigabot() error {
-	if u.gigabotCmd == nil || u.gigabotCmd.Process == nil {
-		return nil
+func (m *markerWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.found {
+		return len(p), nil
 	}
 
-	fmt.Printf("Enviando señal de terminación a PID %d...\n", u.gigabotCmd.Process.Pid)
+	buf := append(m.tail, p...)
+	if bytes.Contains(buf, m.marker) {
+		m.found = true
+		m.tail = nil
+		return len(p), nil
+	}
 
-	if err := u.gigabotCmd.Process.Signal(os.Interrupt); err != nil {
-		u.gigabotCmd.Process.Kill()
+	keep := len(m.marker) - 1
+	if len(buf) > keep {
+		buf = buf[len(buf)-keep:]
 	}
+	m.tail = append([]byte(nil), buf...)
+	return len(p), nil
+}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- u.gigabotCmd.Wait()
-	}()
+func (m *markerWriter) seen() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.found
+}
 
-	select {
-	case <-done:
-		fmt.Println("Gigabot detenido")
-	case <-time.After(10 * time.Second):
-		fmt.Println("Timeout esperando, forzando kill...")
-		u.gigabotCmd.Process.Kill()
+// client devuelve un cliente HTTP para hablar con Nexo. Todos comparten el
+// transporte, así la verificación TLS es la misma en cada pedido.
+func (u *Updater) client(timeout time.Duration) *http.Client {
+	if u.device != nil {
+		return &http.Client{Transport: u.device, Timeout: timeout}
 	}
+	return &http.Client{Transport: u.transport, Timeout: timeout}
+}
 
-	u.gigabotCmd = nil
-	return nil
+// deviceAuth agrega el token de dispositivo a cada pedido a Nexo. El token
+// se carga al arrancar o cuando el updater se registra.
+type deviceAuth struct {
+	base  http.RoundTripper
+	mu    sync.Mutex
+	token string
 }
 
-func parsePublicKey(publicKeyPEM []byte) (ed25519.PublicKey, error) {
-	// Eliminar BOM si existe
-	if len(publicKeyPEM) >= 3 && publicKeyPEM[0] == 0xEF && publicKeyPEM[1] == 0xBB && publicKeyPEM[2] == 0xBF {
-		publicKeyPEM = publicKeyPEM[3:]
+func (d *deviceAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	token := d.token
+	d.mu.Unlock()
+	if token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	return d.base.RoundTrip(req)
+}
 
-	// Buscar los headers PEM
-	beginMarker := "-----BEGIN PUBLIC KEY-----"
-	endMarker := "-----END PUBLIC KEY-----"
+func (d *deviceAuth) enrolled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.token != ""
+}
 
-	beginIdx := strings.Index(string(publicKeyPEM), beginMarker)
-	endIdx := strings.Index(string(publicKeyPEM), endMarker)
+// enroll registra el dispositivo en Nexo y guarda el token que devuelve.
+// Nexo responde 401 hasta que un admin lo aprueba.
+func (u *Updater) enroll() error {
+	name := u.config.DeviceName
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		name = deviceName(hostname)
+	}
+	body, _ := json.Marshal(map[string]string{
+		"name":      name,
+		"platform":  u.config.Platform,
+		"client_id": u.clientID,
+	})
 
-	var keyData string
+	resp, err := u.client(30*time.Second).Post(u.config.VpsHost+"/devices/enroll", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("error HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
 
-	if beginIdx != -1 && endIdx != -1 && beginIdx < endIdx {
-		// Extraer entre los markers
-		start := beginIdx + len(beginMarker)
-		keyData = string(publicKeyPEM[start:endIdx])
-	} else {
-		// Si no hay markers PEM, usar todo el contenido
-		keyData = string(publicKeyPEM)
+	var result struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Token == "" {
+		return fmt.Errorf("respuesta de registro inválida")
+	}
+	if err := os.WriteFile(u.config.DeviceTokenPath, []byte(result.Token+"\n"), 0600); err != nil {
+		return fmt.Errorf("guardando token: %w", err)
 	}
 
-	// Limpiar: quitar espacios, saltos de línea, tabs, carriage returns
-	clean := strings.Map(func(r rune) rune {
-		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
-			return -1
-		}
-		return r
-	}, keyData)
+	u.device.mu.Lock()
+	u.device.token = result.Token
+	u.device.mu.Unlock()
+	fmt.Printf("Dispositivo registrado en Nexo como %s (id %s), pendiente de aprobación\n", name, result.ID)
+	return nil
+}
 
-	// Debug: mostrar primeros 50 caracteres
-	preview := clean
-	if len(preview) > 50 {
-		preview = preview[:50]
+// deviceName adapta el hostname a los nombres que acepta Nexo: letras,
+// números, punto, guion y guion bajo, hasta 64 caracteres.
+func deviceName(hostname string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, strings.TrimSuffix(hostname, ".local"))
+	name = strings.TrimLeft(name, "._-")
+	if len(name) > 64 {
+		name = name[:64]
 	}
-	fmt.Printf("Debug - Limpiando clave, preview: %s...\n", preview)
-	fmt.Printf("Debug - Longitud después de limpiar: %d\n", len(clean))
-
-	if len(clean) == 0 {
-		return nil, fmt.Errorf("clave pública vacía después de limpiar")
+	if name == "" {
+		name = "mac"
 	}
+	return name
+}
 
-	keyBytes, err := base64.StdEncoding.DecodeString(clean)
-	if err != nil {
-		// Intentar con URL encoding alternativo
-		keyBytes, err = base64.URLEncoding.DecodeString(clean)
+// newTransport arma el transporte hacia Nexo con la CA, los pins y el
+// certificado de cliente de la configuración.
+func newTransport(config Config) (*http.Transport, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CACert != "" {
+		caPEM, err := os.ReadFile(config.CACert)
 		if err != nil {
-			return nil, fmt.Errorf("error decodificando base64: %w (primeros chars: %q)", err, clean[:min(20, len(clean))])
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%s no tiene certificados PEM", config.CACert)
 		}
+		tlsConfig.RootCAs = roots
 	}
 
-	fmt.Printf("Debug - Bytes decodificados: %d\n", len(keyBytes))
-
-	if len(keyBytes) == 32 {
-		return ed25519.PublicKey(keyBytes), nil
+	if len(config.Pins) > 0 {
+		pins := config.Pins
+		// Corre después de la verificación normal de la cadena: el pin se
+		// suma, no la reemplaza
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					for _, pin := range pins {
+						if bytes.Equal(sum[:], pin) {
+							return nil
+						}
+					}
+				}
+			}
+			return errors.New("ningún certificado de Nexo coincide con los pins configurados")
+		}
 	}
 
-	if len(keyBytes) > 32 {
-		// Algunas claves PEM incluyen metadata adicional, tomar los últimos 32 bytes
-		return ed25519.PublicKey(keyBytes[len(keyBytes)-32:]), nil
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, errors.New("hacen falta client-cert y client-key")
+		}
+		if _, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey); err != nil {
+			return nil, fmt.Errorf("certificado de cliente: %w", err)
+		}
+		// Se lee en cada handshake para tomar el certificado renovado sin
+		// reiniciar el updater
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("certificado de cliente: %w", err)
+			}
+			return &cert, nil
+		}
 	}
 
-	return nil, fmt.Errorf("clave pública inválida: %d bytes (esperado 32)", len(keyBytes))
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// parsePin acepta el SHA-256 del SPKI en base64, con o sin el prefijo
+// "sha256//" de curl (--pinnedpubkey).
+func parsePin(value string) ([]byte, error) {
+	value = strings.TrimLeft(strings.TrimPrefix(value, "sha256"), "/")
+	pin, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("se esperaba el SHA-256 del SPKI en base64")
 	}
-	return b
+	return pin, nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanhecl/gigabot-remote-updater/internal/keyfile"
+)
+
+func TestReadConfigFileExtension(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"updater.json", `{"channel": "beta"}`, ""},
+		{"updater.JSON", `{"channel": "beta"}`, ""},
+		{"updater.yaml", "channel: beta\n", "YAML no está soportado"},
+		{"updater.yml", "channel: beta\n", "YAML no está soportado"},
+		{"updater", `{"channel": "beta"}`, "solo JSON"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		values, err := readConfigFile(path)
+		if test.wantErr == "" {
+			if err != nil || len(values) != 1 || values[0].value != "beta" {
+				t.Errorf("%s: valores %v, error %v", test.name, values, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: error %v, se esperaba %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// signedMetadata arma la metadata de una release con su manifest firmado.
+func signedMetadata(t *testing.T, privateKey ed25519.PrivateKey, version string) *Metadata {
+	t.Helper()
+	manifestJSON, err := json.Marshal(&Manifest{
+		Version:  version,
+		Platform: "darwin/arm64",
+		Checksum: "abc",
+		Expires:  time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Metadata{
+		Version:           version,
+		Platform:          "darwin/arm64",
+		Checksum:          "abc",
+		Manifest:          base64.StdEncoding.EncodeToString(manifestJSON),
+		ManifestSignature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifestJSON)),
+	}
+}
+
+func TestManifestlessAfterManifestInstall(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Updater{
+		keys:      []*keyfile.Key{{ID: "deploy", PublicKey: publicKey}},
+		statePath: filepath.Join(t.TempDir(), ".gigabot-state.json"),
+	}
+
+	legacy := &Metadata{Version: "20260201-120000", Platform: "darwin/arm64"}
+	if err := u.verifyManifest(legacy, false); err != nil {
+		t.Fatalf("release sin manifest antes de instalar una con manifest: %v", err)
+	}
+
+	signed := signedMetadata(t, privateKey, "20260101-120000")
+	if err := u.verifyManifest(signed, false); err != nil {
+		t.Fatalf("release con manifest: %v", err)
+	}
+	u.recordInstall(signed)
+	if !u.state.ManifestInstalled {
+		t.Fatal("recordInstall no registró el manifest")
+	}
+
+	// Una build vieja sin manifest presentada como más nueva
+	legacy = &Metadata{Version: "20260201-120000", Platform: "darwin/arm64"}
+	if err := u.verifyManifest(legacy, false); err == nil {
+		t.Error("se aceptó una release sin manifest después de instalar una con manifest")
+	}
+
+	// El flag sobrevive a un reinicio
+	data, err := os.ReadFile(u.statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil || !state.ManifestInstalled {
+		t.Errorf("manifest_installed no quedó en el estado (%v)", err)
+	}
+}
+
+func TestStalenessSurvivesRestart(t *testing.T) {
+	lastSeen := time.Now().Add(-30 * time.Hour)
+	tests := []struct {
+		name  string
+		state State
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"timestamp de antes del reinicio", State{LastTimestamp: lastSeen.Format(time.RFC3339)}, 30*time.Hour - time.Minute, 30*time.Hour + time.Minute},
+		{"nunca vio un timestamp", State{}, 0, time.Minute},
+		{"timestamp ilegible", State{LastTimestamp: "ayer"}, 0, time.Minute},
+	}
+	for _, test := range tests {
+		// Un updater recién arrancado con el estado que dejó el anterior
+		u := &Updater{startedAt: time.Now(), state: test.state}
+		if got := u.staleness(); got < test.min || got > test.max {
+			t.Errorf("%s: staleness = %s, se esperaba entre %s y %s", test.name, got, test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+var stopSignals = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// setProcessGroup lanza cmd en su propio grupo de procesos, así la señal de
+// stop le llega también a lo que lance Gigabot.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalGroup manda sig a todo el grupo de procesos de p, o solo a p si el
+// grupo no existe.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-p.Pid, sig); err != nil {
+		return p.Signal(sig)
+	}
+	return nil
+}
+
+// killGroup mata lo que quede del grupo de procesos de p. Devuelve error si
+// ya no queda ninguno.
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// setUser hace que Gigabot corra como otro usuario (el updater tiene que
+// correr como root).
+func setUser(cmd *exec.Cmd, name string) error {
+	credential, env, err := lookupCredential(name)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = credential
+	cmd.Env = append(cmd.Env, env...)
+	return nil
+}
+
+// lookupCredential devuelve uid/gid del usuario y las variables HOME, USER
+// y LOGNAME para que Gigabot no herede las de root.
+func lookupCredential(name string) (*syscall.Credential, []string, error) {
+	account, err := user.Lookup(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("usuario %s: %w", name, err)
+	}
+	uid, err := strconv.ParseUint(account.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("uid inválido para %s: %s", name, account.Uid)
+	}
+	gid, err := strconv.ParseUint(account.Gid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("gid inválido para %s: %s", name, account.Gid)
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIDs, err := account.GroupIds(); err == nil {
+		for _, g := range groupIDs {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				credential.Groups = append(credential.Groups, uint32(id))
+			}
+		}
+	}
+
+	env := []string{"HOME=" + account.HomeDir, "USER=" + account.Username, "LOGNAME=" + account.Username}
+	return credential, env, nil
+}
+
+// startWithUmask inicia cmd con el umask indicado (-1 = heredar el del
+// updater). El umask se hereda al hacer fork, así que se cambia solo
+// mientras se lanza el proceso.
+func startWithUmask(cmd *exec.Cmd, umask int) error {
+	if umask < 0 {
+		return cmd.Start()
+	}
+	previous := syscall.Umask(umask)
+	defer syscall.Umask(previous)
+	return cmd.Start()
+}
@@ -0,0 +1,45 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// En Windows no hay señales para otro proceso: cualquiera de estas termina
+// Gigabot con Process.Kill.
+var stopSignals = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+}
+
+// setProcessGroup no hace nada en Windows: no hay grupos de procesos a los
+// que mandar una señal.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup termina p; en Windows no se puede mandar otra señal ni
+// alcanzar a sus hijos.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Kill()
+}
+
+// killGroup termina p si sigue vivo.
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// setUser no está soportado en Windows: Gigabot corre con el usuario del
+// updater.
+func setUser(cmd *exec.Cmd, name string) error {
+	return errors.New("la opción user no está soportada en Windows")
+}
+
+// startWithUmask inicia cmd; Windows no tiene umask y la opción se ignora.
+func startWithUmask(cmd *exec.Cmd, umask int) error {
+	return cmd.Start()
+}